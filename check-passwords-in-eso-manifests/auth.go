@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const defaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultLogin получает токен Vault методом из VAULT_AUTH_METHOD:
+//
+//	token      - статический VAULT_TOKEN (по умолчанию)
+//	approle    - VAULT_ROLE_ID и VAULT_SECRET_ID
+//	kubernetes - JWT сервисного аккаунта пода (VAULT_K8S_TOKEN_PATH) и роль VAULT_ROLE
+//	jwt        - GitLab CI id_token (VAULT_JWT, либо CI_JOB_JWT_V2/CI_JOB_JWT) и роль VAULT_ROLE
+//
+// Точка монтирования метода задаётся VAULT_AUTH_MOUNT (по умолчанию совпадает с именем метода).
+// Возвращает функцию, которая отзывает полученный при логине токен
+func vaultLogin() (func(), error) {
+	method := getVariableOrDefault("VAULT_AUTH_METHOD", "token")
+	if method == "token" {
+		vaultToken = getVariable("VAULT_TOKEN", true)
+		// статический токен не наш - не отзываем его
+		return func() {}, nil
+	}
+
+	if vaultAddr == "" {
+		return nil, errors.New("для VAULT_AUTH_METHOD=" + method + " нужна переменная VAULT_ADDR")
+	}
+	mount := strings.Trim(getVariableOrDefault("VAULT_AUTH_MOUNT", method), "/")
+
+	var payload map[string]string
+	switch method {
+	case "approle":
+		payload = map[string]string{
+			"role_id":   getVariable("VAULT_ROLE_ID", true),
+			"secret_id": getVariable("VAULT_SECRET_ID", true),
+		}
+	case "kubernetes":
+		jwt, err := ioutil.ReadFile(getVariableOrDefault("VAULT_K8S_TOKEN_PATH", defaultKubernetesTokenPath))
+		if err != nil {
+			return nil, err
+		}
+		payload = map[string]string{
+			"role": getVariable("VAULT_ROLE", true),
+			"jwt":  strings.TrimSpace(string(jwt)),
+		}
+	case "jwt":
+		jwt := getVariable("VAULT_JWT", false)
+		if jwt == "" {
+			jwt = getVariable("CI_JOB_JWT_V2", false)
+		}
+		if jwt == "" {
+			jwt = getVariable("CI_JOB_JWT", false)
+		}
+		if jwt == "" {
+			return nil, errors.New("не найден JWT: задайте VAULT_JWT (id_tokens в .gitlab-ci.yml)")
+		}
+		payload = map[string]string{
+			"role": getVariable("VAULT_ROLE", false),
+			"jwt":  jwt,
+		}
+	default:
+		return nil, errors.New("неизвестный VAULT_AUTH_METHOD: " + method)
+	}
+
+	debugOutput("Логинимся в Vault методом " + method + " (auth/" + mount + ")")
+	status, body, err := vaultAPI.Write(strings.TrimRight(vaultAddr, "/")+"/v1/auth/"+mount+"/login", payload)
+	if reason, details := vaultFailure(status, body, err); reason != "" {
+		return nil, errors.New("логин в Vault не удался: " + string(reason) + " " + details)
+	}
+	vaultToken = gjson.Get(body, "auth.client_token").String()
+	if vaultToken == "" {
+		return nil, errors.New("логин в Vault не удался: в ответе нет auth.client_token")
+	}
+
+	return func() {
+		debugOutput("Отзываем полученный токен Vault")
+		status, body, err := vaultAPI.Write(strings.TrimRight(vaultAddr, "/")+"/v1/auth/token/revoke-self", map[string]string{})
+		if reason, details := vaultFailure(status, body, err); reason != "" {
+			debugOutput("!!! Не удалось отозвать токен Vault: " + string(reason) + " " + details)
+		}
+	}, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLogin - fakeVault с адресом в VAULT_ADDR и без токена: его должен получить vaultLogin
+func testLogin(t *testing.T) *fakeVault {
+	t.Helper()
+	vault := newFakeVault()
+	server := vault.start(t)
+	previousAddr := vaultAddr
+	vaultAddr = server.URL + "/"
+	vaultToken = ""
+	t.Cleanup(func() { vaultAddr = previousAddr })
+	for _, name := range []string{"VAULT_AUTH_MOUNT", "VAULT_ROLE", "VAULT_JWT", "CI_JOB_JWT_V2", "CI_JOB_JWT", "VAULT_TOKEN"} {
+		t.Setenv(name, "")
+	}
+	return vault
+}
+
+func TestVaultLogin(t *testing.T) {
+	jwtFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwtFile, []byte("k8s-jwt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		env     map[string]string
+		path    string
+		payload map[string]string
+	}{
+		{
+			name:    "approle",
+			env:     map[string]string{"VAULT_AUTH_METHOD": "approle", "VAULT_ROLE_ID": "role-id", "VAULT_SECRET_ID": "secret-id"},
+			path:    "auth/approle/login",
+			payload: map[string]string{"role_id": "role-id", "secret_id": "secret-id"},
+		},
+		{
+			name:    "kubernetes с другой точкой монтирования",
+			env:     map[string]string{"VAULT_AUTH_METHOD": "kubernetes", "VAULT_AUTH_MOUNT": "/k8s/prod/", "VAULT_ROLE": "eso-check", "VAULT_K8S_TOKEN_PATH": jwtFile},
+			path:    "auth/k8s/prod/login",
+			payload: map[string]string{"role": "eso-check", "jwt": "k8s-jwt"},
+		},
+		{
+			name:    "jwt из id_token",
+			env:     map[string]string{"VAULT_AUTH_METHOD": "jwt", "VAULT_AUTH_MOUNT": "gitlab", "VAULT_ROLE": "ci", "VAULT_JWT": "id-token", "CI_JOB_JWT_V2": "old-token"},
+			path:    "auth/gitlab/login",
+			payload: map[string]string{"role": "ci", "jwt": "id-token"},
+		},
+		{
+			name:    "jwt из CI_JOB_JWT_V2",
+			env:     map[string]string{"VAULT_AUTH_METHOD": "jwt", "CI_JOB_JWT_V2": "old-token"},
+			path:    "auth/jwt/login",
+			payload: map[string]string{"role": "", "jwt": "old-token"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := testLogin(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			revoke, err := vaultLogin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vaultToken != fakeVaultToken {
+				t.Errorf("токен из ответа на логин не сохранён: %q", vaultToken)
+			}
+			vault.mu.Lock()
+			payload := vault.logins[tt.path]
+			vault.mu.Unlock()
+			if len(payload) != len(tt.payload) {
+				t.Errorf("логин %s: %v, ожидали %v", tt.path, payload, tt.payload)
+			}
+			for k, v := range tt.payload {
+				if payload[k] != v {
+					t.Errorf("%s = %q, ожидали %q", k, payload[k], v)
+				}
+			}
+			if n := vault.count("POST", "auth/token/revoke-self"); n != 0 {
+				t.Errorf("токен отозван до завершения: %d", n)
+			}
+			revoke()
+			if n := vault.count("POST", "auth/token/revoke-self"); n != 1 {
+				t.Errorf("revoke-self вызван %d раз", n)
+			}
+		})
+	}
+}
+
+func TestVaultLoginStaticToken(t *testing.T) {
+	vault := testLogin(t)
+	t.Setenv("VAULT_AUTH_METHOD", "token")
+	t.Setenv("VAULT_TOKEN", "static")
+	revoke, err := vaultLogin()
+	if err != nil || vaultToken != "static" {
+		t.Fatalf("токен %q, ошибка %v", vaultToken, err)
+	}
+	revoke()
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+	if len(vault.requests) != 0 {
+		t.Errorf("статический токен не логинится и не отзывается: %v", vault.requests)
+	}
+}
+
+func TestVaultLoginErrors(t *testing.T) {
+	testLogin(t)
+	for _, env := range []map[string]string{
+		{"VAULT_AUTH_METHOD": "ldap"},
+		{"VAULT_AUTH_METHOD": "jwt"},
+		{"VAULT_AUTH_METHOD": "kubernetes", "VAULT_ROLE": "eso-check", "VAULT_K8S_TOKEN_PATH": filepath.Join(t.TempDir(), "missing")},
+	} {
+		for name, value := range env {
+			t.Setenv(name, value)
+		}
+		if _, err := vaultLogin(); err == nil {
+			t.Errorf("%v: ожидали ошибку", env)
+		}
+	}
+
+	vault := testLogin(t)
+	vault.failures["auth/approle/login"] = []int{400}
+	t.Setenv("VAULT_AUTH_METHOD", "approle")
+	t.Setenv("VAULT_ROLE_ID", "role-id")
+	t.Setenv("VAULT_SECRET_ID", "wrong")
+	if _, err := vaultLogin(); err == nil {
+		t.Error("отказ Vault в логине должен возвращаться ошибкой")
+	}
+}
+
+func TestRunRevokesTokenOnError(t *testing.T) {
+	vault := testLogin(t)
+	t.Setenv("VAULT_ADDR", vaultAddr)
+	t.Setenv("LOOKUP_FOLDER", t.TempDir())
+	t.Setenv("VAULT_AUTH_METHOD", "approle")
+	t.Setenv("VAULT_ROLE_ID", "role-id")
+	t.Setenv("VAULT_SECRET_ID", "secret-id")
+	t.Setenv("VAULT_CACERT", "")
+
+	previousArgs, previousFlags, previousStore := os.Args, flag.CommandLine, defaultStore
+	t.Cleanup(func() { os.Args, flag.CommandLine, defaultStore = previousArgs, previousFlags, previousStore })
+	flag.CommandLine = flag.NewFlagSet("check-eso", flag.ContinueOnError)
+	// после логина run завершается с ошибкой: файла политики нет
+	os.Args = []string{"check-eso", "--policy", filepath.Join(t.TempDir(), "missing.yaml")}
+
+	if code := run(); code != 1 {
+		t.Errorf("код завершения %d", code)
+	}
+	if n := vault.count("POST", "auth/approle/login"); n != 1 {
+		t.Errorf("логинов %d", n)
+	}
+	if n := vault.count("POST", "auth/token/revoke-self"); n != 1 {
+		t.Errorf("revoke-self вызван %d раз, ожидали один", n)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/tidwall/gjson"
+)
+
+// SecretBackend - откуда проверки берут секреты: живой Vault или снимок путей и свойств (--snapshot)
+type SecretBackend interface {
+	// ReadSecret возвращает данные секрета (key/value). version - версия KV v2, пустая строка - последняя версия
+	ReadSecret(store VaultProvider, key string, version string) (gjson.Result, FailureReason, string)
+	// ListSecrets возвращает содержимое папки в mount. Вложенные папки оканчиваются на "/"
+	ListSecrets(store VaultProvider, mount string, folder string) ([]string, FailureReason, string)
+	// ReadMetadata возвращает метаданные секрета KV v2. false - метаданные недоступны
+	ReadMetadata(store VaultProvider, key string) (gjson.Result, bool)
+}
+
+var secretBackend SecretBackend = liveVault{}
+
+// liveVault - запросы к Vault через vaultAPI
+type liveVault struct{}
+
+func (liveVault) ReadSecret(store VaultProvider, key string, version string) (gjson.Result, FailureReason, string) {
+	url := store.SecretURL(key)
+	if version != "" && store.Version != "v1" {
+		url += "?version=" + version
+	}
+	status, body, err := vaultRequest("GET", url)
+	if reason, details := vaultFailure(status, body, err); reason != "" {
+		return gjson.Result{}, reason, details
+	}
+	return gjson.Get(body, store.DataPath()), "", ""
+}
+
+func (liveVault) ListSecrets(store VaultProvider, mount string, folder string) ([]string, FailureReason, string) {
+	status, body, err := vaultRequest("LIST", store.ListURL(mount, folder))
+	if reason, details := vaultFailure(status, body, err); reason != "" {
+		return nil, reason, details
+	}
+	var keys []string
+	for _, k := range gjson.Get(body, "data.keys").Array() {
+		keys = append(keys, k.String())
+	}
+	return keys, "", ""
+}
+
+func (liveVault) ReadMetadata(store VaultProvider, key string) (gjson.Result, bool) {
+	if store.Version == "v1" {
+		return gjson.Result{}, false
+	}
+	status, body, err := vaultRequest("GET", store.MetadataURL(key))
+	if reason, _ := vaultFailure(status, body, err); reason != "" {
+		return gjson.Result{}, false
+	}
+	return gjson.Get(body, "data"), true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// CapabilitiesConfig - учётные записи, под которыми ESO читает секреты из хранилищ (режим --check-capabilities)
+type CapabilitiesConfig struct {
+	Stores []StoreIdentity `yaml:"stores"`
+}
+
+// StoreIdentity связывает хранилище с токеном ESO: по accessor токена или по токену из переменной окружения.
+// Пустые kind/namespace подходят к любому хранилищу с таким именем, name "*" - к любому хранилищу
+type StoreIdentity struct {
+	Kind      string `yaml:"kind"`
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	Accessor  string `yaml:"accessor"`
+	TokenEnv  string `yaml:"tokenEnv"`
+}
+
+// Проверять ли права учётной записи хранилища ESO на чтение секретов
+var checkCapabilities bool
+
+var capabilitiesCache = struct {
+	mu      sync.Mutex
+	entries map[string]*vaultCacheEntry
+}{entries: map[string]*vaultCacheEntry{}}
+
+// IdentityFor находит учётную запись хранилища, на которое ссылается ExternalSecret из namespace. nil - не задана
+func (c CapabilitiesConfig) IdentityFor(namespace string, ref SecretStoreRef) *StoreIdentity {
+	kind := ref.Kind
+	if kind == "" {
+		kind = "SecretStore"
+	}
+	for i, identity := range c.Stores {
+		if identity.Name != "*" && identity.Name != ref.Name {
+			continue
+		}
+		if identity.Kind != "" && identity.Kind != kind {
+			continue
+		}
+		if identity.Namespace != "" && kind == "SecretStore" && identity.Namespace != namespace {
+			continue
+		}
+		return &c.Stores[i]
+	}
+	return nil
+}
+
+func (i *StoreIdentity) String() string {
+	if i.Accessor != "" {
+		return "accessor " + i.Accessor
+	}
+	return "токен из " + i.TokenEnv
+}
+
+// checkStoreCanRead спрашивает у Vault (sys/capabilities-accessor или sys/capabilities),
+// может ли учётная запись хранилища прочитать секрет. Токену проверки нужен доступ к этим эндпоинтам
+func checkStoreCanRead(identity *StoreIdentity, store VaultProvider, key string) (FailureReason, string) {
+	return checkStoreCapabilities(identity, store, key, ReasonStoreCannotRead, "read")
+}
+
+// checkStoreCanWrite проверяет, что учётная запись хранилища может записать секрет (PushSecret):
+// достаточно create для нового секрета или update для существующего
+func checkStoreCanWrite(identity *StoreIdentity, store VaultProvider, key string) (FailureReason, string) {
+	return checkStoreCapabilities(identity, store, key, ReasonStoreCannotWrite, "create", "update")
+}
+
+// checkStoreCapabilities возвращает denied, если у учётной записи на путь секрета нет ни одного из прав accepted (или root)
+func checkStoreCapabilities(identity *StoreIdentity, store VaultProvider, key string, denied FailureReason, accepted ...string) (FailureReason, string) {
+	path := store.SecretPath(key)
+	url := strings.TrimRight(store.Server, "/") + "/v1/sys/capabilities"
+	payload := map[string]interface{}{"paths": []string{path}}
+	if identity.Accessor != "" {
+		url += "-accessor"
+		payload["accessor"] = identity.Accessor
+	} else {
+		token := getVariable(identity.TokenEnv, false)
+		if token == "" {
+			return ReasonIdentityUnknown, "переменная " + identity.TokenEnv + " не задана"
+		}
+		payload["token"] = token
+	}
+
+	capabilitiesCache.mu.Lock()
+	entry, found := capabilitiesCache.entries[identity.String()+" "+url+" "+path]
+	if !found {
+		entry = &vaultCacheEntry{}
+		capabilitiesCache.entries[identity.String()+" "+url+" "+path] = entry
+	}
+	capabilitiesCache.mu.Unlock()
+	entry.once.Do(func() {
+		entry.status, entry.body, entry.err = vaultAPI.Write(url, payload)
+	})
+	if reason, details := vaultFailure(entry.status, entry.body, entry.err); reason != "" {
+		return reason, "sys/capabilities: " + details
+	}
+
+	capabilities := gjson.Get(entry.body, "capabilities")
+	if !capabilities.Exists() {
+		capabilities = gjson.Get(entry.body, "data.capabilities")
+	}
+	var names []string
+	for _, c := range capabilities.Array() {
+		if c.String() == "root" {
+			return "", ""
+		}
+		for _, a := range accepted {
+			if c.String() == a {
+				return "", ""
+			}
+		}
+		names = append(names, c.String())
+	}
+	return denied, identity.String() + ", путь " + path + ", права: " + strings.Join(names, ", ")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckStoreCanRead(t *testing.T) {
+	vault, kv2, kv1 := testVault(t)
+	vault.allowed = func(apiPath string) bool { return strings.HasPrefix(apiPath, "bd/data/app/") }
+
+	identity := &StoreIdentity{Name: "vault", Accessor: "eso-app"}
+	if reason, details := checkStoreCanRead(identity, kv2, "app/db"); reason != "" {
+		t.Errorf("app/db: %q (%s)", reason, details)
+	}
+	reason, details := checkStoreCanRead(identity, kv1, "team/api")
+	if reason != ReasonStoreCannotRead || !strings.Contains(details, "kv1/team/api") {
+		t.Errorf("team/api: %q (%s)", reason, details)
+	}
+
+	t.Setenv("ESO_TOKEN", "")
+	if reason, _ := checkStoreCanRead(&StoreIdentity{Name: "vault", TokenEnv: "ESO_TOKEN"}, kv2, "app/db"); reason != ReasonIdentityUnknown {
+		t.Errorf("без токена: %q", reason)
+	}
+}
+
+func TestIdentityFor(t *testing.T) {
+	capabilities := CapabilitiesConfig{Stores: []StoreIdentity{
+		{Kind: "ClusterSecretStore", Name: "vault", Accessor: "cluster"},
+		{Name: "vault", Namespace: "payments", Accessor: "payments"},
+		{Name: "*", Accessor: "any"},
+	}}
+	tests := []struct {
+		namespace string
+		ref       SecretStoreRef
+		accessor  string
+	}{
+		{namespace: "app", ref: SecretStoreRef{Kind: "ClusterSecretStore", Name: "vault"}, accessor: "cluster"},
+		{namespace: "payments", ref: SecretStoreRef{Name: "vault"}, accessor: "payments"},
+		{namespace: "app", ref: SecretStoreRef{Name: "vault"}, accessor: "any"},
+	}
+	for _, tt := range tests {
+		identity := capabilities.IdentityFor(tt.namespace, tt.ref)
+		if identity == nil || identity.Accessor != tt.accessor {
+			t.Errorf("%s %s/%s: %+v", tt.ref.Kind, tt.namespace, tt.ref.Name, identity)
+		}
+	}
+	if (CapabilitiesConfig{}).IdentityFor("app", SecretStoreRef{Name: "vault"}) != nil {
+		t.Error("учётная запись найдена в пустых настройках")
+	}
+}
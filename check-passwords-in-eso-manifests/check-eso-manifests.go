@@ -1,22 +1,23 @@
 package main
 
 import (
-	"bytes"
-	"io/ioutil"
+	"flag"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/tidwall/gjson"
-	"gopkg.in/yaml.v3"
 )
 
 const debug = false
 
 var lookupFolder, vaultToken, vaultAddr string
 
+// Проверять ли dataFrom.find: для поиска секретов нужно право list, которого у токена может не быть
+var checkFind bool
+
+// Хранилище по умолчанию: используется для ExternalSecret, чей secretStoreRef не найден среди манифестов
+var defaultStore VaultProvider
+
 func getVariable(curVar string, mandatory bool) string {
 	tmpVar := os.Getenv(curVar)
 	if len(tmpVar) == 0 && mandatory {
@@ -25,6 +26,14 @@ func getVariable(curVar string, mandatory bool) string {
 	return tmpVar
 }
 
+func getVariableOrDefault(curVar string, defaultValue string) string {
+	tmpVar := os.Getenv(curVar)
+	if len(tmpVar) == 0 {
+		return defaultValue
+	}
+	return tmpVar
+}
+
 func checkError(err error) {
 	if err != nil {
 		panic(err)
@@ -49,90 +58,350 @@ func FilePathWalkDir(root string, extension string) ([]string, error) {
 	return files, err
 }
 
-func IsESOManifest(fileName string) bool {
-	// ищем что манифест имеет kind: ExternalSecret
-	const signature = "kind: ExternalSecret"
-	fl, err := ioutil.ReadFile(fileName)
-	checkError(err)
-	return strings.Contains(string(fl), signature)
+func IsESOManifest(src ManifestSource) bool {
+	// ищем что манифест имеет kind: ExternalSecret или kind: ClusterExternalSecret
+	return src.HasKind("kind: ExternalSecret", "kind: ClusterExternalSecret")
 }
 
-func isSecretInVaultExists(path2secret string, secretName string) bool {
-	req, err := http.NewRequest("GET", vaultAddr+"/v1/bd/data/"+path2secret, nil)
-	checkError(err)
-	req.Header.Add("X-Vault-Token", vaultToken)
+func IsSecretStoreManifest(src ManifestSource) bool {
+	// ищем что манифест имеет kind: SecretStore или kind: ClusterSecretStore
+	return src.HasKind("kind: SecretStore", "kind: ClusterSecretStore")
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Fatal(err)
+// isSecretInVaultExists проверяет наличие свойства секрета в Vault (для KV v2 - с учётом закреплённой версии).
+// Если секрет не найден - возвращает причину и подробности (текст ошибки)
+func isSecretInVaultExists(store VaultProvider, path2secret string, secretName string, version string) (bool, FailureReason, string) {
+	if version != "" {
+		if reason, details := checkPinnedVersion(store, path2secret, version); reason != "" {
+			return false, reason, details
+		}
 	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	secret, reason, details := readVaultSecret(store, path2secret, version)
+	if reason == ReasonPathNotFound {
+		if version == "" {
+			if reason, details := checkDeletedLatestVersion(store, path2secret, secretName); reason != "" {
+				return false, reason, details
+			}
+		}
+		return false, reason, suggestPath(store, path2secret)
+	}
+	if reason != "" {
+		return false, reason, details
 	}
 
-	tmpSecret := gjson.Get(string(body), "data.data."+secretName)
+	if secretName == "" {
+		// без property ESO забирает секрет целиком - достаточно того, что путь существует
+		return true, "", ""
+	}
+	tmpSecret := secret.Get(secretName)
 	if tmpSecret.Value() == nil {
-		return false
+		return false, ReasonPropertyNotFound, suggestProperty(secret, secretName)
 	}
-	return true
+	return true, "", ""
 }
 
-func enumVaultSecretsForManifestExists(fileName string) {
-	type Manifest struct {
-		Spec struct {
-			RefreshInterval string `yaml:"refreshInterval"`
-			Data            []struct {
-				SecretKey string `yaml:"secretKey"`
-				RemoteRef struct {
-					Key      string `yaml:"key"`
-					Property string `yaml:"property"`
-				} `yaml:"remoteRef"`
-			} `yaml:"data"`
-		} `yaml:"spec"`
-	}
-
-	fl, err := ioutil.ReadFile(fileName)
-	checkError(err)
-
-	dec := yaml.NewDecoder(bytes.NewReader(fl))
-
-	for {
-		var manifest Manifest
-		if dec.Decode(&manifest) != nil {
-			break
-		}
-		for _, v := range manifest.Spec.Data {
-			debugOutput("---> Проверяем наличие секрета: " + v.RemoteRef.Property + " путь в Vault: " + v.RemoteRef.Key)
-			if !isSecretInVaultExists(v.RemoteRef.Key, v.RemoteRef.Property) {
-				debugOutput("!!! [Fail!] ---> Секрет " + v.RemoteRef.Property + " в ветке " + v.RemoteRef.Key + " не найден. !!!")
-				debugOutput(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>><<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<")
-				log.Fatal(">>>>         Проверьте корректность секрета! Возможно опечатка. Аварийно завершаем пайплайн.        <<<<<")
-				debugOutput(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>><<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<")
-			} else {
-				debugOutput("---- [Ok!] ---> Секрет " + v.RemoteRef.Key + "/" + v.RemoteRef.Property + " найден в хранилище")
+// enumVaultSecretsForManifestExists ставит в пул проверки всех ссылок ExternalSecret из манифеста
+func enumVaultSecretsForManifestExists(src ManifestSource, stores *StoreIndex, diff *DiffScope, pool *workerPool, targets *TargetIndex, report *Report) {
+	fileName := src.File
+
+	for _, manifest := range decodeExternalSecrets(src) {
+		changes := diff.Changes(manifest)
+		if changes == nil || len(manifest.Spec.DataFrom) == 0 {
+			targets.RegisterStatic(manifest)
+		}
+		if changes == nil {
+			debugOutput("---> ExternalSecret " + manifest.Metadata.Name + " не изменился относительно " + diff.ref + ", пропускаем")
+			continue
+		}
+		store, err := stores.Resolve(manifest.Metadata.Namespace, manifest.Spec.SecretStoreRef)
+		if err != nil {
+			for _, v := range manifest.Spec.Data {
+				report.AddFinding(Finding{
+					File:           fileName,
+					Line:           v.RemoteRef.Line,
+					Kind:           manifest.ReportKind(),
+					ExternalSecret: manifest.Metadata.Name,
+					Key:            v.RemoteRef.Key,
+					Property:       v.RemoteRef.Property,
+					Reason:         ReasonStoreNotResolved,
+					Details:        err.Error(),
+				})
 			}
+			for _, v := range manifest.Spec.DataFrom {
+				report.AddFinding(Finding{
+					File:           fileName,
+					Line:           v.Line,
+					Kind:           manifest.ReportKind(),
+					ExternalSecret: manifest.Metadata.Name,
+					Key:            v.Describe(),
+					Reason:         ReasonStoreNotResolved,
+					Details:        err.Error(),
+				})
+			}
+			if len(manifest.Spec.DataFrom) > 0 {
+				targets.RegisterStatic(manifest)
+			}
+			continue
+		}
+		var identity *StoreIdentity
+		if checkCapabilities {
+			identity = config.Capabilities.IdentityFor(manifest.Metadata.Namespace, manifest.Spec.SecretStoreRef)
+			if identity == nil {
+				report.AddFinding(Finding{
+					File:           fileName,
+					Kind:           manifest.ReportKind(),
+					ExternalSecret: manifest.Metadata.Name,
+					Key:            "secretStoreRef " + manifest.Spec.SecretStoreRef.Name,
+					Reason:         ReasonIdentityUnknown,
+					Details:        "добавьте хранилище в capabilities.stores файла --config",
+				})
+			}
+		}
+		for i, v := range manifest.Spec.Data {
+			if !changes.CheckData(i) {
+				continue
+			}
+			name, kind := manifest.Metadata.Name, manifest.ReportKind()
+			ref := v.RemoteRef
+			pool.Go(func() {
+				debugOutput("---> Проверяем наличие секрета: " + ref.Property + " путь в Vault: " + store.SecretURL(ref.Key))
+				ok, reason, details := isSecretInVaultExists(store, ref.Key, ref.Property, ref.Version)
+				if ok && identity != nil {
+					reason, details = checkStoreCanRead(identity, store, ref.Key)
+					ok = reason == ""
+				}
+				if !ok && warningReasons[reason] {
+					debugOutput("!!! [Warn!] ---> Секрет " + ref.Property + " в ветке " + ref.Key + ": " + string(reason) + " !!!")
+				} else if !ok {
+					debugOutput("!!! [Fail!] ---> Секрет " + ref.Property + " в ветке " + ref.Key + ": " + string(reason) + " !!!")
+				} else {
+					debugOutput("---- [Ok!] ---> Секрет " + ref.Key + "/" + ref.Property + " найден в хранилище")
+				}
+				report.AddFinding(Finding{
+					File:           fileName,
+					Line:           ref.Line,
+					Kind:           kind,
+					ExternalSecret: name,
+					Key:            ref.Key,
+					Property:       ref.Property,
+					Reason:         reason,
+					Details:        details,
+				})
+			})
+		}
+		if changes.CheckDataFrom() {
+			manifest := manifest
+			pool.Go(func() {
+				providedKeys, complete := checkDataFrom(manifest, store, identity, report)
+				checkTemplate(manifest, providedKeys, complete, report)
+				if len(manifest.Spec.DataFrom) > 0 {
+					targets.Register(manifest, providedKeys, complete)
+				}
+			})
+		} else if len(manifest.Spec.DataFrom) > 0 {
+			targets.RegisterStatic(manifest)
 		}
 	}
 }
 
-func main() {
+// readEnvironment читает LOOKUP_FOLDER и VAULT_ADDR
+func readEnvironment() {
 	if debug {
 		lookupFolder = "."
-		vaultToken = getVariable("VAULT_TOKEN", false)
 		vaultAddr = "https://vault.bd.domain.com"
 	} else {
 		lookupFolder = getVariable("LOOKUP_FOLDER", true)
-		vaultToken = getVariable("VAULT_TOKEN", true)
-		vaultAddr = getVariable("VAULT_ADDR", true)
+		vaultAddr = getVariable("VAULT_ADDR", false)
 	}
+}
 
+// setupVault настраивает клиента Vault, логинится и задаёт хранилище по умолчанию.
+// Возвращает функцию, которая отзывает полученный токен
+func setupVault() func() {
+	vaultAPI = vaultClientFromEnv()
+	revokeToken, err := vaultLogin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	setDefaultStore()
+	return revokeToken
+}
+
+func setDefaultStore() {
+	defaultStore = VaultProvider{
+		Server:  vaultAddr,
+		Path:    getVariableOrDefault("VAULT_MOUNT", "bd"),
+		Version: getVariableOrDefault("VAULT_KV_VERSION", "v2"),
+	}
+}
+
+// loadSources читает манифесты из LOOKUP_FOLDER (или рендерит их) и находит описанные в них хранилища
+func loadSources(render bool, report *Report) ([]ManifestSource, *StoreIndex) {
 	listOfManifests, _ := FilePathWalkDir(lookupFolder, "yaml")
-	for _, manifest := range listOfManifests {
-		if IsESOManifest(manifest) {
-			debugOutput("Найден новый манифест c 'kind: ExternalSecret', путь к файлу: " + manifest)
-			enumVaultSecretsForManifestExists(manifest)
+
+	var sources []ManifestSource
+	if render {
+		sources = renderSources(lookupFolder, listOfManifests, report)
+	} else {
+		sources = readSources(listOfManifests)
+	}
+
+	stores := NewStoreIndex()
+	for _, src := range sources {
+		if IsSecretStoreManifest(src) {
+			debugOutput("Найден манифест SecretStore/ClusterSecretStore, путь к файлу: " + src.File)
+			stores.LoadSource(src)
 		}
 	}
+	return sources, stores
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inventory":
+			runInventory(os.Args[2:])
+			return
+		case "orphans":
+			runOrphans(os.Args[2:])
+			return
+		case "snapshot":
+			runSnapshot(os.Args[2:])
+			return
+		}
+	}
+	os.Exit(run())
+}
+
+// run выполняет проверку манифестов и возвращает код завершения. После логина в Vault ошибки возвращаются,
+// а не завершают процесс, чтобы отложенный отзыв токена выполнился при любом исходе
+func run() int {
+	format := flag.String("format", "text", "формат отчёта: text, junit или codequality")
+	output := flag.String("output", "", "файл для отчёта в формате junit/codequality (по умолчанию stdout)")
+	flag.BoolVar(&checkFind, "check-find", false, "проверять dataFrom.find (нужно право list в Vault)")
+	render := flag.Bool("render", false, "собирать kustomize оверлеи и шаблонизировать локальные Helm чарты из HelmRelease перед проверкой")
+	concurrency := flag.Int("concurrency", 8, "число одновременных запросов к Vault")
+	configFile := flag.String("config", "", "YAML файл настроек проверки")
+	flag.BoolVar(&checkCapabilities, "check-capabilities", false, "проверять через sys/capabilities, что учётная запись хранилища ESO (из capabilities.stores в --config) может читать секреты, а для PushSecret - записывать")
+	scanPlaintext := flag.Bool("scan-plaintext", false, "искать секреты в открытом виде: Secret с data/stringData, токены и строки с высокой энтропией в ConfigMap и env контейнеров. Ложные срабатывания исключаются через --allowlist")
+	allowlistFile := flag.String("allowlist", "", "файл с известными ложными срабатываниями --scan-plaintext: строки <файл> или <файл>:<ключ>, допускаются шаблоны filepath.Match")
+	policyFile := flag.String("policy", "", "YAML файл с разрешёнными путями Vault для namespace и папок репозитория")
+	flag.BoolVar(&checkParity, "parity", false, "сравнивать ExternalSecret одного приложения в папках окружений (parity в --config)")
+	snapshotFile := flag.String("snapshot", "", "проверять по снимку путей и свойств Vault из файла вместо Vault (создаётся подкомандой snapshot)")
+	gitlabMR := flag.Bool("gitlab-mr", false, "публиковать результаты в merge request: заметка с таблицей и обсуждения на строках (CI_PROJECT_ID, CI_MERGE_REQUEST_IID, GITLAB_TOKEN)")
+	since := flag.String("since", "", "проверять только ExternalSecret, изменённые относительно git ревизии (в MR: $CI_MERGE_REQUEST_DIFF_BASE_SHA)")
+	flag.Parse()
+
+	readEnvironment()
+	if err := loadConfig(*configFile); err != nil {
+		log.Fatal("Не удалось прочитать файл настроек " + *configFile + ": " + err.Error())
+	}
+	if checkCapabilities && len(config.Capabilities.Stores) == 0 {
+		log.Fatal("Для --check-capabilities нужен --config с разделом capabilities.stores")
+	}
+	revokeToken := func() {}
+	if *snapshotFile != "" {
+		if checkCapabilities {
+			log.Fatal("--check-capabilities не работает со --snapshot: в снимке нет политик Vault")
+		}
+		snapshot, err := loadSnapshot(*snapshotFile)
+		if err != nil {
+			log.Fatal("Не удалось прочитать снимок Vault " + *snapshotFile + ": " + err.Error())
+		}
+		secretBackend = snapshot
+		if vaultAddr == "" {
+			// адрес нужен только для сообщений - в снимке сервер не учитывается
+			vaultAddr = "snapshot:" + *snapshotFile
+		}
+		setDefaultStore()
+	} else {
+		revokeToken = setupVault()
+	}
+	defer revokeToken()
+
+	report := &Report{}
+	sources, stores := loadSources(*render, report)
+
+	var diff *DiffScope
+	var err error
+	if *since != "" {
+		diff, err = NewDiffScope(*since, lookupFolder, *render)
+		if err != nil {
+			log.Println("Не удалось сравнить манифесты с ревизией " + *since + ": " + err.Error())
+			return 1
+		}
+	}
+
+	if *scanPlaintext {
+		allowlist, err := loadAllowlist(*allowlistFile)
+		if err != nil {
+			log.Println("Не удалось прочитать allowlist " + *allowlistFile + ": " + err.Error())
+			return 1
+		}
+		for _, src := range sources {
+			if diff.SourceChanged(src) {
+				scanPlaintextSecrets(src, allowlist, report)
+			}
+		}
+	}
+
+	var externalSecrets []ExternalSecret
+	changedFiles := map[string]bool{}
+	for _, src := range sources {
+		if IsESOManifest(src) {
+			externalSecrets = append(externalSecrets, decodeExternalSecrets(src)...)
+			changedFiles[src.File] = changedFiles[src.File] || diff.SourceChanged(src)
+		}
+	}
+	isChangedExternalSecret := func(manifest ExternalSecret) bool {
+		return changedFiles[manifest.File] && diff.ManifestChanged(manifest)
+	}
+	lintExternalSecrets(externalSecrets, isChangedExternalSecret, report)
+
+	policy, err := loadPathPolicy(*policyFile)
+	if err != nil {
+		log.Println("Не удалось прочитать политику " + *policyFile + ": " + err.Error())
+		return 1
+	}
+	if policy != nil {
+		checkPathPolicy(externalSecrets, stores, policy, isChangedExternalSecret, report)
+	}
+
+	targets := NewTargetIndex()
+	pool := newWorkerPool(*concurrency)
+	if checkParity {
+		checkEnvironmentParity(externalSecrets, stores, pool, isChangedExternalSecret, report)
+	}
+	for _, src := range sources {
+		if !IsESOManifest(src) {
+			continue
+		}
+		if !diff.SourceChanged(src) {
+			continue
+		}
+		debugOutput("Найден новый манифест c 'kind: ExternalSecret', путь к файлу: " + src.File)
+		enumVaultSecretsForManifestExists(src, stores, diff, pool, targets, report)
+	}
+	pool.Wait()
+	checkWorkloadSecretRefs(sources, targets, diff.SourceChanged, isChangedExternalSecret, report)
+	checkPushSecrets(sources, stores, targets, pool, diff.SourceChanged, report)
+	pool.Wait()
+
+	report.Print()
+	if *format != "text" {
+		if err := report.Write(*format, *output); err != nil {
+			log.Println("Не удалось записать отчёт в формате " + *format + ": " + err.Error())
+			return 1
+		}
+	}
+	if *gitlabMR {
+		// недоступность GitLab не должна менять результат проверки
+		if err := publishGitLabReport(report); err != nil {
+			log.Println("Не удалось опубликовать результаты в merge request: " + err.Error())
+		}
+	}
+	if report.HasFailures() {
+		return 1
+	}
+	return 0
 }
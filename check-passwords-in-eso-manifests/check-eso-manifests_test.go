@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testVault(t *testing.T) (*fakeVault, VaultProvider, VaultProvider) {
+	t.Helper()
+	vault := newFakeVault()
+	vault.put("bd/app/db", map[string]interface{}{"DB_PASSWORD": "secret", "DB_USER": "app"})
+	vault.put("bd/app/config", map[string]interface{}{"database": map[string]interface{}{"host": "db"}})
+	vault.put("kv1/team/api", map[string]interface{}{"TOKEN": "t"})
+
+	// v1 жива, v2 удалена, v3 уничтожена
+	vault.put("bd/app/rotated", map[string]interface{}{"OLD": "1"})
+	vault.put("bd/app/rotated", map[string]interface{}{"OLD": "1", "NEW": "2"})
+	vault.secrets["bd/app/rotated"][1] = fakeVersion{data: map[string]interface{}{"NEW": "2"}, deleted: true}
+	vault.put("bd/app/rotated", map[string]interface{}{"NEW": "3"})
+	vault.secrets["bd/app/rotated"][2] = fakeVersion{data: map[string]interface{}{"NEW": "3"}, destroyed: true}
+
+	server := vault.start(t)
+	kv2 := VaultProvider{Server: server.URL, Path: "bd", Version: "v2"}
+	kv1 := VaultProvider{Server: server.URL, Path: "kv1", Version: "v1"}
+	return vault, kv2, kv1
+}
+
+func TestIsSecretInVaultExists(t *testing.T) {
+	_, kv2, kv1 := testVault(t)
+
+	tests := []struct {
+		name     string
+		store    VaultProvider
+		key      string
+		property string
+		version  string
+		ok       bool
+		reason   FailureReason
+		details  string
+	}{
+		{name: "свойство есть", store: kv2, key: "app/db", property: "DB_PASSWORD", ok: true},
+		{name: "секрет целиком", store: kv2, key: "app/db", ok: true},
+		{name: "вложенное свойство", store: kv2, key: "app/config", property: "database.host", ok: true},
+		{name: "KV v1", store: kv1, key: "team/api", property: "TOKEN", ok: true},
+		{name: "опечатка в свойстве", store: kv2, key: "app/db", property: "DB_PASWORD", reason: ReasonPropertyNotFound, details: "DB_PASSWORD"},
+		{name: "опечатка в пути", store: kv2, key: "app/dbb", property: "DB_PASSWORD", reason: ReasonPathNotFound, details: "app/db"},
+		{name: "путь KV v1", store: kv1, key: "team/apii", property: "TOKEN", reason: ReasonPathNotFound, details: "api"},
+		{name: "закреплённая живая версия", store: kv2, key: "app/rotated", property: "OLD", version: "1", ok: true},
+		{name: "закреплённая удалённая версия", store: kv2, key: "app/rotated", property: "NEW", version: "2", reason: ReasonVersionDeleted},
+		{name: "закреплённая уничтоженная версия", store: kv2, key: "app/rotated", property: "NEW", version: "3", reason: ReasonVersionDestroyed},
+		{name: "нет версии", store: kv2, key: "app/rotated", property: "NEW", version: "7", reason: ReasonVersionNotFound, details: "1, 2, 3"},
+		{name: "последняя версия удалена, свойство есть в старой", store: kv2, key: "app/rotated", property: "OLD", reason: ReasonLatestDeleted, details: "версии 1"},
+		{name: "последняя версия удалена, свойства нет", store: kv2, key: "app/rotated", property: "NEW", reason: ReasonVersionDestroyed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason, details := isSecretInVaultExists(tt.store, tt.key, tt.property, tt.version)
+			if ok != tt.ok || reason != tt.reason {
+				t.Fatalf("получили %v, %q (%s), ожидали %v, %q", ok, reason, details, tt.ok, tt.reason)
+			}
+			if !strings.Contains(details, tt.details) {
+				t.Errorf("подробности %q не содержат %q", details, tt.details)
+			}
+		})
+	}
+}
+
+func TestEnumVaultSecretsForManifestExists(t *testing.T) {
+	_, kv2, _ := testVault(t)
+
+	src := ManifestSource{File: "apps/app/es.yaml", Content: []byte(`apiVersion: external-secrets.io/v1beta1
+kind: SecretStore
+metadata:
+  name: vault
+  namespace: app
+spec:
+  provider:
+    vault:
+      server: ` + kv2.Server + `
+      path: bd
+      version: v2
+---
+apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  target:
+    name: db
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+  - secretKey: user
+    remoteRef:
+      key: app/db
+      property: DB_USR
+  dataFrom:
+  - extract:
+      key: app/missing
+`)}
+	stores := NewStoreIndex()
+	stores.LoadSource(src)
+	report := &Report{}
+	targets := NewTargetIndex()
+	pool := newWorkerPool(2)
+	enumVaultSecretsForManifestExists(src, stores, nil, pool, targets, report)
+	pool.Wait()
+
+	failures := map[int]Finding{}
+	for _, f := range report.Failures() {
+		failures[f.Line] = f
+	}
+	if len(failures) != 2 {
+		t.Fatalf("ожидали 2 ошибки, получили %+v", report.Failures())
+	}
+	if f := failures[30]; f.Reason != ReasonPropertyNotFound || f.Property != "DB_USR" || !strings.Contains(f.Details, "DB_USER") {
+		t.Errorf("строка 30: %+v", f)
+	}
+	if f := failures[33]; f.Reason != ReasonPathNotFound || f.ExternalSecret != "db" {
+		t.Errorf("строка 33: %+v", f)
+	}
+	if !report.HasFailures() {
+		t.Error("HasFailures() = false при ошибках")
+	}
+
+	target := targets.Find("app", src.File, "db")
+	if target == nil || !target.Keys["password"] || !target.Keys["user"] || target.Complete {
+		t.Errorf("целевой Secret: %+v", target)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config - настройки проверки из файла --config
+type Config struct {
+	Capabilities CapabilitiesConfig `yaml:"capabilities"`
+	// Lint - серьёзность правил lint: имя правила -> error, warning или off
+	Lint    map[string]string `yaml:"lint"`
+	Parity  ParityConfig      `yaml:"parity"`
+	Orphans OrphansConfig     `yaml:"orphans"`
+}
+
+var config Config
+
+// loadConfig читает YAML файл настроек. Пустой путь - настройки по умолчанию
+func loadConfig(path string) error {
+	if path == "" {
+		return config.Parity.setDefaults()
+	}
+	fl, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(fl, &config); err != nil {
+		return err
+	}
+	if err := config.Parity.setDefaults(); err != nil {
+		return err
+	}
+	return validateLintConfig(config.Lint)
+}
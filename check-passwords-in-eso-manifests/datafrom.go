@@ -0,0 +1,226 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// checkDataFrom проверяет элементы spec.dataFrom и возвращает набор ключей, которые получит целевой Secret.
+// Второе значение false, если набор ключей неполный (find не проверялся, ошибка чтения, transform в rewrite).
+// Если задана identity - для extract дополнительно проверяется право хранилища ESO на чтение
+func checkDataFrom(manifest ExternalSecret, store VaultProvider, identity *StoreIdentity, report *Report) (map[string]bool, bool) {
+	providedKeys := map[string]bool{}
+	complete := true
+	for _, v := range manifest.Spec.Data {
+		providedKeys[v.SecretKey] = true
+	}
+
+	for _, v := range manifest.Spec.DataFrom {
+		var keys []string
+		var reason FailureReason
+		var details string
+		switch {
+		case v.Extract != nil:
+			debugOutput("---> Проверяем dataFrom.extract, путь в Vault: " + store.SecretURL(v.Extract.Key))
+			keys, reason, details = extractKeys(store, *v.Extract)
+			if reason == "" && identity != nil {
+				reason, details = checkStoreCanRead(identity, store, v.Extract.Key)
+			}
+		case v.Find != nil:
+			if !checkFind {
+				debugOutput("---> Пропускаем " + v.Describe() + ": проверка find не включена (--check-find)")
+				complete = false
+				continue
+			}
+			debugOutput("---> Проверяем " + v.Describe())
+			keys, reason, details = findKeys(store, *v.Find)
+		default:
+			continue
+		}
+
+		if reason != "" {
+			debugOutput("!!! [Fail!] ---> " + v.Describe() + ": " + string(reason) + " !!!")
+			complete = false
+		}
+		report.AddFinding(Finding{
+			File:           manifest.File,
+			Line:           v.Line,
+			Kind:           manifest.ReportKind(),
+			ExternalSecret: manifest.Metadata.Name,
+			Key:            v.Describe(),
+			Reason:         reason,
+			Details:        details,
+		})
+
+		rewritten, ok := rewriteKeys(keys, v.Rewrite)
+		if !ok {
+			complete = false
+		}
+		for _, k := range rewritten {
+			providedKeys[k] = true
+		}
+	}
+	return providedKeys, complete
+}
+
+// extractKeys читает секрет целиком (или JSON объект из property) и возвращает его ключи
+func extractKeys(store VaultProvider, ref RemoteRef) ([]string, FailureReason, string) {
+	secret, reason, details := readVaultSecret(store, ref.Key, ref.Version)
+	if reason == ReasonPathNotFound {
+		return nil, reason, suggestPath(store, ref.Key)
+	}
+	if reason != "" {
+		return nil, reason, details
+	}
+	if ref.Property != "" {
+		if !secret.Get(ref.Property).Exists() {
+			return nil, ReasonPropertyNotFound, suggestProperty(secret, ref.Property)
+		}
+		secret = secret.Get(ref.Property)
+		if secret.Type == gjson.String {
+			// ESO разбирает строковое значение property как JSON
+			secret = gjson.Parse(secret.String())
+		}
+		if !secret.IsObject() {
+			return nil, ReasonNotAnObject, ref.Property
+		}
+	}
+	var keys []string
+	secret.ForEach(func(key, value gjson.Result) bool {
+		keys = append(keys, key.String())
+		return true
+	})
+	return keys, "", ""
+}
+
+// findKeys ищет секреты по dataFrom.find и возвращает ключи, под которыми ESO положит найденные секреты
+func findKeys(store VaultProvider, find ExternalSecretFind) ([]string, FailureReason, string) {
+	var nameRegexp *regexp.Regexp
+	if find.Name != nil {
+		var err error
+		nameRegexp, err = regexp.Compile(find.Name.RegExp)
+		if err != nil {
+			return nil, ReasonInvalidRegexp, err.Error()
+		}
+	}
+
+	mount, folder := store.SplitKey(find.Path)
+	secrets, reason, details := listVaultSecretsRecursive(store, mount, folder)
+	if reason != "" {
+		return nil, reason, details
+	}
+
+	var keys []string
+	for _, secretPath := range secrets {
+		if nameRegexp != nil && !nameRegexp.MatchString(secretPath) {
+			continue
+		}
+		if len(find.Tags) > 0 && !hasVaultTags(store, mount+"/"+secretPath, find.Tags) {
+			continue
+		}
+		keys = append(keys, strings.ReplaceAll(secretPath, "/", "_"))
+	}
+	if len(keys) == 0 {
+		return nil, ReasonFindNoMatch, ""
+	}
+	return keys, "", ""
+}
+
+// hasVaultTags проверяет custom_metadata секрета (KV v2) на совпадение с tags из find
+func hasVaultTags(store VaultProvider, key string, tags map[string]string) bool {
+	metadata, ok := readVaultMetadata(store, key)
+	if !ok {
+		return false
+	}
+	customMetadata := metadata.Get("custom_metadata").Map()
+	for tag, value := range tags {
+		if customMetadata[tag].String() != value {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteKeys применяет dataFrom.rewrite к ключам. transform-шаблоны не вычисляются - тогда набор ключей неполный
+func rewriteKeys(keys []string, rewrites []ExternalSecretRewrite) ([]string, bool) {
+	for _, rw := range rewrites {
+		if rw.Regexp == nil {
+			return keys, false
+		}
+		re, err := regexp.Compile(rw.Regexp.Source)
+		if err != nil {
+			return keys, false
+		}
+		rewritten := make([]string, 0, len(keys))
+		for _, k := range keys {
+			rewritten = append(rewritten, re.ReplaceAllString(k, rw.Regexp.Target))
+		}
+		keys = rewritten
+	}
+	return keys, true
+}
+
+var (
+	templateActionRegexp = regexp.MustCompile(`{{-?(.*?)-?}}`)
+	templateFieldRegexp  = regexp.MustCompile(`(?:^|[\s(|])\.([A-Za-z_][A-Za-z0-9_]*)`)
+	templateIndexRegexp  = regexp.MustCompile(`index\s+\.\s+"([^"]+)"`)
+)
+
+// templateKeys возвращает ключи, которые шаблон берёт из данных секрета: {{ .key }} и {{ index . "key" }}
+func templateKeys(tpl string) []string {
+	found := map[string]bool{}
+	for _, action := range templateActionRegexp.FindAllStringSubmatch(tpl, -1) {
+		for _, m := range templateFieldRegexp.FindAllStringSubmatch(action[1], -1) {
+			found[m[1]] = true
+		}
+		for _, m := range templateIndexRegexp.FindAllStringSubmatch(action[1], -1) {
+			found[m[1]] = true
+		}
+	}
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkTemplate проверяет, что каждый ключ, используемый в target.template.data, предоставлен data/dataFrom
+func checkTemplate(manifest ExternalSecret, providedKeys map[string]bool, complete bool, report *Report) {
+	template := manifest.Spec.Target.Template
+	if template == nil || len(template.Data) == 0 {
+		return
+	}
+	if !complete {
+		debugOutput("---> Пропускаем проверку шаблона ExternalSecret " + manifest.Metadata.Name + ": набор ключей dataFrom определить не удалось")
+		return
+	}
+
+	names := make([]string, 0, len(template.Data))
+	for name := range template.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, key := range templateKeys(template.Data[name]) {
+			var reason FailureReason
+			if !providedKeys[key] {
+				debugOutput("!!! [Fail!] ---> Шаблон " + name + " использует ключ " + key + ", которого нет в data/dataFrom !!!")
+				reason = ReasonTemplateKey
+			}
+			report.AddFinding(Finding{
+				File:           manifest.File,
+				Line:           template.Line,
+				Kind:           manifest.ReportKind(),
+				ExternalSecret: manifest.Metadata.Name,
+				Key:            "target.template.data." + name,
+				Property:       key,
+				Reason:         reason,
+			})
+		}
+	}
+}
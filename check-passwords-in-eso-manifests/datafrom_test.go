@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplateKeys(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		tpl  string
+		want string
+	}{
+		{name: "поле с функцией", tpl: `{{ .a | b64dec }}`, want: "a"},
+		{name: "index с дефисом", tpl: `{{ index . "k-with-dash" }}`, want: "k-with-dash"},
+		{name: "printf с несколькими полями", tpl: `postgres://{{ printf "%s:%s@%s" .user .password (.host | lower) }}/db`, want: "host,password,user"},
+		{name: "обрезка пробелов", tpl: "{{- .token -}}\n{{ .token }}", want: "token"},
+		{name: "несколько действий", tpl: `{{ .DB_USER }}:{{ index . "db.password" }}`, want: "DB_USER,db.password"},
+		{name: "текст вне действий", tpl: `plain .text {{ "literal" }}`, want: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(templateKeys(tt.tpl), ","); got != tt.want {
+				t.Errorf("templateKeys(%q) = %q, ожидали %q", tt.tpl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindKeys(t *testing.T) {
+	vault, kv2, _ := testVault(t)
+	vault.put("bd/jobs/cleanup", map[string]interface{}{"TOKEN": "t"})
+	vault.put("bd/jobs/backup/daily", map[string]interface{}{"TOKEN": "t"})
+
+	find := func(path string, name string) ExternalSecretFind {
+		f := ExternalSecretFind{Path: path}
+		if name != "" {
+			f.Name = &struct {
+				RegExp string `yaml:"regexp"`
+			}{RegExp: name}
+		}
+		return f
+	}
+	for _, tt := range []struct {
+		name   string
+		find   ExternalSecretFind
+		want   string
+		reason FailureReason
+	}{
+		{name: "весь каталог", find: find("jobs", ""), want: "jobs_backup_daily,jobs_cleanup"},
+		{name: "фильтр по имени", find: find("jobs", "^jobs/clean"), want: "jobs_cleanup"},
+		{name: "ничего не найдено", find: find("jobs", "^jobs/none"), reason: ReasonFindNoMatch},
+		{name: "некорректное выражение", find: find("jobs", "("), reason: ReasonInvalidRegexp},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, reason, details := findKeys(kv2, tt.find)
+			if got := strings.Join(keys, ","); got != tt.want || reason != tt.reason {
+				t.Errorf("получили %q, %q (%s), ожидали %q, %q", got, reason, details, tt.want, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRewriteKeys(t *testing.T) {
+	regexpRewrite := func(source string, target string) ExternalSecretRewrite {
+		var rw ExternalSecretRewrite
+		rw.Regexp = &struct {
+			Source string `yaml:"source"`
+			Target string `yaml:"target"`
+		}{Source: source, Target: target}
+		return rw
+	}
+	keys := []string{"jobs_cleanup", "jobs_backup_daily"}
+
+	// правила применяются по очереди, каждое к результату предыдущего
+	got, ok := rewriteKeys(keys, []ExternalSecretRewrite{regexpRewrite(`^jobs_(.*)$`, "JOB_$1"), regexpRewrite(`^JOB_([a-z]+)_(.*)$`, "${2}_$1")})
+	if strings.Join(got, ",") != "JOB_cleanup,daily_backup" || !ok {
+		t.Errorf("rewriteKeys = %v, %v", got, ok)
+	}
+	if _, ok := rewriteKeys(keys, []ExternalSecretRewrite{regexpRewrite(`(`, "")}); ok {
+		t.Error("некорректное выражение должно делать набор ключей неполным")
+	}
+	var transform ExternalSecretRewrite
+	transform.Transform = &struct {
+		Template string `yaml:"template"`
+	}{Template: "{{ .value | upper }}"}
+	if _, ok := rewriteKeys(keys, []ExternalSecretRewrite{transform}); ok {
+		t.Error("transform не вычисляется, набор ключей должен быть неполным")
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	vault, kv2, _ := testVault(t)
+	vault.put("bd/jobs/cleanup", map[string]interface{}{"TOKEN": "t"})
+	previous := checkFind
+	checkFind = true
+	t.Cleanup(func() { checkFind = previous })
+
+	manifests := decodeExternalSecrets(ManifestSource{File: "apps/app/es.yaml", Content: []byte(`apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: app
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  target:
+    template:
+      data:
+        dsn: '{{ printf "%s:%s" .user (.password | b64dec) }}'
+        job: '{{ index . "JOB-cleanup" }}'
+        extracted: '{{ .DB_USER }}'
+        broken: '{{ .user }}/{{ .missing }}'
+  data:
+  - secretKey: user
+    remoteRef:
+      key: app/db
+      property: DB_USER
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+  dataFrom:
+  - extract:
+      key: app/db
+  - find:
+      path: jobs
+    rewrite:
+    - regexp:
+        source: "^jobs_(.*)$"
+        target: "JOB-$1"
+`)})
+	if len(manifests) != 1 {
+		t.Fatalf("манифестов %d", len(manifests))
+	}
+	report := &Report{}
+	keys, complete := checkDataFrom(manifests[0], kv2, nil, report)
+	if !complete || !keys["JOB-cleanup"] || !keys["DB_PASSWORD"] {
+		t.Fatalf("ключи %v, полный набор %v", keys, complete)
+	}
+	checkTemplate(manifests[0], keys, complete, report)
+
+	failures := report.Failures()
+	if len(failures) != 1 {
+		t.Fatalf("ожидали одну ошибку, получили %+v", failures)
+	}
+	if f := failures[0]; f.Reason != ReasonTemplateKey || f.Key != "target.template.data.broken" || f.Property != "missing" || f.Line != 11 {
+		t.Errorf("ошибка шаблона: %+v", f)
+	}
+
+	// без --check-find ключи find неизвестны, шаблон не проверяется
+	checkFind = false
+	report = &Report{}
+	keys, complete = checkDataFrom(manifests[0], kv2, nil, report)
+	checkTemplate(manifests[0], keys, complete, report)
+	if complete || report.HasFailures() {
+		t.Errorf("полный набор %v, ошибки %+v", complete, report.Failures())
+	}
+}
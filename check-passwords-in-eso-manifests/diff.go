@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DiffScope хранит ExternalSecret базовой ревизии, с которыми сравниваются текущие манифесты в режиме --since.
+// nil DiffScope означает полную проверку
+type DiffScope struct {
+	ref string
+	// изменённые файлы (абсолютные пути). nil - в режиме render, где сравниваются все отрендеренные манифесты
+	changedFiles map[string]bool
+	base         map[string]ExternalSecret
+}
+
+// ExternalSecretChanges - какие части ExternalSecret нужно проверить
+type ExternalSecretChanges struct {
+	// All - ExternalSecret новый или у него сменилось хранилище
+	All  bool
+	Data map[int]bool
+	// DataFromOrTemplate - изменились dataFrom, шаблон или набор ключей, который использует шаблон
+	DataFromOrTemplate bool
+}
+
+func (c *ExternalSecretChanges) CheckData(i int) bool {
+	return c.All || c.Data[i]
+}
+
+func (c *ExternalSecretChanges) CheckDataFrom() bool {
+	return c.All || c.DataFromOrTemplate
+}
+
+// NewDiffScope находит YAML файлы, изменённые относительно ref, и разбирает их версии из ref.
+// В режиме render базовая ревизия выкачивается во временный worktree и рендерится целиком
+func NewDiffScope(ref string, lookupFolder string, render bool) (*DiffScope, error) {
+	topLevel, err := gitOutput(lookupFolder, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	topLevel = strings.TrimSpace(topLevel)
+
+	d := &DiffScope{ref: ref, base: map[string]ExternalSecret{}}
+	if render {
+		return d, d.loadRenderedBase(topLevel, lookupFolder)
+	}
+
+	changed, err := gitOutput(lookupFolder, "diff", "--name-only", "--no-renames", "-z", ref, "--", ".")
+	if err != nil {
+		return nil, err
+	}
+	d.changedFiles = map[string]bool{}
+	for _, name := range strings.Split(changed, "\x00") {
+		if name == "" || !strings.Contains(name, "yaml") {
+			continue
+		}
+		d.changedFiles[absPath(filepath.Join(topLevel, name))] = true
+		// у добавленных файлов нет версии в ref - git show вернёт ошибку, это нормально
+		content, err := gitOutput(topLevel, "show", ref+":"+name)
+		if err != nil {
+			continue
+		}
+		d.addBase(ManifestSource{File: name, Content: []byte(content)})
+	}
+	debugOutput("Режим --since " + ref + ": изменённых YAML файлов " + strconv.Itoa(len(d.changedFiles)))
+	return d, nil
+}
+
+func (d *DiffScope) loadRenderedBase(topLevel string, lookupFolder string) error {
+	worktree, err := ioutil.TempDir("", "check-eso-base-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(worktree)
+	if _, err := gitOutput(topLevel, "worktree", "add", "--detach", worktree, d.ref); err != nil {
+		return err
+	}
+	defer gitOutput(topLevel, "worktree", "remove", "--force", worktree)
+
+	rel, err := filepath.Rel(topLevel, absPath(lookupFolder))
+	if err != nil {
+		return err
+	}
+	baseFolder := filepath.Join(worktree, rel)
+	files, _ := FilePathWalkDir(baseFolder, "yaml")
+	// ошибки рендера базовой ревизии не относятся к MR - не добавляем их в отчёт
+	for _, src := range renderSources(baseFolder, files, &Report{}) {
+		d.addBase(src)
+	}
+	debugOutput("Режим --since " + d.ref + ": в базовой ревизии ExternalSecret " + strconv.Itoa(len(d.base)))
+	return nil
+}
+
+func (d *DiffScope) addBase(src ManifestSource) {
+	for _, manifest := range decodeExternalSecrets(src) {
+		d.base[manifest.Identity()] = manifest
+	}
+}
+
+// SourceChanged - нужно ли вообще разбирать манифест: файл изменён в MR (или режим без --since)
+func (d *DiffScope) SourceChanged(src ManifestSource) bool {
+	if d == nil || d.changedFiles == nil {
+		return true
+	}
+	return d.changedFiles[absPath(src.File)]
+}
+
+// Changes сравнивает ExternalSecret с его версией в базовой ревизии. nil - изменений нет
+func (d *DiffScope) Changes(manifest ExternalSecret) *ExternalSecretChanges {
+	if d == nil {
+		return &ExternalSecretChanges{All: true}
+	}
+	old, found := d.base[manifest.Identity()]
+	if !found || old.Spec.SecretStoreRef != manifest.Spec.SecretStoreRef {
+		return &ExternalSecretChanges{All: true}
+	}
+
+	changes := &ExternalSecretChanges{Data: map[int]bool{}}
+	oldRefs := map[string]bool{}
+	for _, v := range old.Spec.Data {
+		oldRefs[v.SecretKey+"|"+v.RemoteRef.Key+"|"+v.RemoteRef.Property+"|"+v.RemoteRef.Version] = true
+	}
+	for i, v := range manifest.Spec.Data {
+		if !oldRefs[v.SecretKey+"|"+v.RemoteRef.Key+"|"+v.RemoteRef.Property+"|"+v.RemoteRef.Version] {
+			changes.Data[i] = true
+		}
+	}
+
+	changes.DataFromOrTemplate = yamlString(old.Spec.DataFrom) != yamlString(manifest.Spec.DataFrom) ||
+		yamlString(old.Spec.Target.Template) != yamlString(manifest.Spec.Target.Template) ||
+		strings.Join(secretKeys(old), ",") != strings.Join(secretKeys(manifest), ",")
+
+	if len(changes.Data) == 0 && !changes.DataFromOrTemplate {
+		return nil
+	}
+	return changes
+}
+
+// ManifestChanged - изменился ли манифест ExternalSecret целиком (для lint), а не только ссылки на секреты
+func (d *DiffScope) ManifestChanged(manifest ExternalSecret) bool {
+	if d == nil {
+		return true
+	}
+	old, found := d.base[manifest.Identity()]
+	return !found || old.APIVersion != manifest.APIVersion || yamlString(old.Spec) != yamlString(manifest.Spec)
+}
+
+func secretKeys(manifest ExternalSecret) []string {
+	var keys []string
+	for _, v := range manifest.Spec.Data {
+		keys = append(keys, v.SecretKey)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func yamlString(v interface{}) string {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("git " + strings.Join(args, " ") + ": " + err.Error() + " " + strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+const diffBaseManifest = `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+  - secretKey: user
+    remoteRef:
+      key: app/db
+      property: DB_USER
+`
+
+func TestDiffScopeSince(t *testing.T) {
+	repo := gitRepo(t, map[string]string{
+		"apps/app/db.yaml":    diffBaseManifest,
+		"apps/app/cache.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cache\n",
+		"apps/other/api.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: api\n",
+	})
+	// меняется property у password, user остаётся как был
+	writeTree(t, repo, map[string]string{
+		"apps/app/db.yaml": `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASS
+  - secretKey: user
+    remoteRef:
+      key: app/db
+      property: DB_USER
+`,
+		"apps/app/new.yaml": "apiVersion: external-secrets.io/v1beta1\nkind: ExternalSecret\nmetadata:\n  name: new\n  namespace: app\n",
+	})
+	git(t, repo, "add", "-A")
+
+	scope, err := NewDiffScope("HEAD", filepath.Join(repo, "apps"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]bool{
+		"apps/app/db.yaml":    true,
+		"apps/app/new.yaml":   true,
+		"apps/app/cache.yaml": false,
+		"apps/other/api.yaml": false,
+	} {
+		if got := scope.SourceChanged(ManifestSource{File: filepath.Join(repo, file)}); got != want {
+			t.Errorf("SourceChanged(%s) = %v, ожидали %v", file, got, want)
+		}
+	}
+
+	sources := readSources([]string{filepath.Join(repo, "apps/app/db.yaml"), filepath.Join(repo, "apps/app/new.yaml")})
+	db := decodeExternalSecrets(sources[0])[0]
+	changes := scope.Changes(db)
+	if changes == nil || changes.All || !changes.CheckData(0) || changes.CheckData(1) || changes.CheckDataFrom() {
+		t.Errorf("изменения db: %+v", changes)
+	}
+	if changes := scope.Changes(decodeExternalSecrets(sources[1])[0]); changes == nil || !changes.All {
+		t.Errorf("новый ExternalSecret должен проверяться целиком: %+v", changes)
+	}
+
+	// без изменений ссылок проверять нечего, а при смене хранилища - всё
+	unchanged := decodeExternalSecrets(ManifestSource{File: "db.yaml", Content: []byte(diffBaseManifest)})[0]
+	if changes := scope.Changes(unchanged); changes != nil {
+		t.Errorf("неизменённый ExternalSecret: %+v", changes)
+	}
+	unchanged.Spec.SecretStoreRef.Name = "vault-prod"
+	if changes := scope.Changes(unchanged); changes == nil || !changes.All {
+		t.Errorf("смена хранилища: %+v", changes)
+	}
+	if (*DiffScope)(nil).Changes(unchanged) == nil || !(*DiffScope)(nil).SourceChanged(sources[0]) {
+		t.Error("без --since проверяется всё")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeVaultToken = "test-token"
+
+// fakeVersion - версия секрета KV v2 в fakeVault
+type fakeVersion struct {
+	data      map[string]interface{}
+	deleted   bool
+	destroyed bool
+}
+
+// fakeVault - Vault в памяти для тестов: KV v1 и KV v2 с версиями, LIST, sys/capabilities,
+// логин и отзыв токена.
+// Секреты хранятся по пути вместе с mount, у KV v1 используется только последняя версия
+type fakeVault struct {
+	// mount -> v1 или v2
+	mounts  map[string]string
+	secrets map[string][]fakeVersion
+	// allowed - пути API (как в sys/capabilities), которые проверяемая учётная запись может читать и записывать
+	allowed func(apiPath string) bool
+
+	mu sync.Mutex
+	// requests - число запросов "<метод> <путь API>"
+	requests map[string]int
+	// failures - коды ответов, которые путь API вернёт по очереди до обычного ответа
+	failures map[string][]int
+	// logins - тело последнего запроса auth/<mount>/login по пути API
+	logins map[string]map[string]string
+}
+
+func newFakeVault() *fakeVault {
+	return &fakeVault{
+		mounts:   map[string]string{"bd": "v2", "kv1": "v1"},
+		secrets:  map[string][]fakeVersion{},
+		allowed:  func(string) bool { return true },
+		requests: map[string]int{},
+		failures: map[string][]int{},
+		logins:   map[string]map[string]string{},
+	}
+}
+
+// count - сколько раз был выполнен запрос method к пути API
+func (f *fakeVault) count(method string, apiPath string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method+" "+apiPath]
+}
+
+func (f *fakeVault) put(secretPath string, data map[string]interface{}) {
+	f.secrets[secretPath] = append(f.secrets[secretPath], fakeVersion{data: data})
+}
+
+// start запускает HTTP сервер и переключает клиента Vault на новый (без кэша и повторов) до конца теста
+func (f *fakeVault) start(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(f)
+	previousAPI, previousToken, previousBackend := vaultAPI, vaultToken, secretBackend
+	vaultAPI = newVaultClient(time.Second, 0, 0)
+	vaultToken = fakeVaultToken
+	secretBackend = liveVault{}
+	t.Cleanup(func() {
+		server.Close()
+		vaultAPI, vaultToken, secretBackend = previousAPI, previousToken, previousBackend
+	})
+	return server
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	apiPath := strings.TrimPrefix(r.URL.Path, "/v1/")
+	f.mu.Lock()
+	f.requests[r.Method+" "+apiPath]++
+	var failure int
+	if codes := f.failures[apiPath]; len(codes) > 0 {
+		failure, f.failures[apiPath] = codes[0], codes[1:]
+	}
+	f.mu.Unlock()
+	if failure != 0 {
+		f.reply(w, failure, nil)
+		return
+	}
+
+	if r.Method == "POST" && strings.HasPrefix(apiPath, "auth/") && strings.HasSuffix(apiPath, "/login") {
+		var payload map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			f.reply(w, http.StatusBadRequest, nil)
+			return
+		}
+		f.mu.Lock()
+		f.logins[apiPath] = payload
+		f.mu.Unlock()
+		f.reply(w, http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{"client_token": fakeVaultToken}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != fakeVaultToken {
+		f.reply(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+	if r.Method == "POST" && apiPath == "auth/token/revoke-self" {
+		f.reply(w, http.StatusNoContent, nil)
+		return
+	}
+	if r.Method == "POST" && (apiPath == "sys/capabilities" || apiPath == "sys/capabilities-accessor") {
+		var payload struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || len(payload.Paths) == 0 {
+			f.reply(w, http.StatusBadRequest, nil)
+			return
+		}
+		capabilities := []string{"deny"}
+		if f.allowed(payload.Paths[0]) {
+			capabilities = []string{"create", "read", "update", "list"}
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"capabilities": capabilities})
+		return
+	}
+
+	parts := strings.SplitN(apiPath, "/", 2)
+	version, found := f.mounts[parts[0]]
+	if !found || len(parts) == 1 {
+		f.reply(w, http.StatusNotFound, nil)
+		return
+	}
+	mount, rest := parts[0], parts[1]
+	if version == "v1" {
+		if r.Method == "LIST" {
+			f.list(w, mount, rest)
+			return
+		}
+		versions := f.secrets[mount+"/"+rest]
+		if len(versions) == 0 {
+			f.reply(w, http.StatusNotFound, nil)
+			return
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"data": versions[len(versions)-1].data})
+		return
+	}
+
+	switch {
+	case r.Method == "LIST" && strings.HasPrefix(rest, "metadata/"):
+		f.list(w, mount, strings.TrimPrefix(rest, "metadata/"))
+	case strings.HasPrefix(rest, "metadata/"):
+		f.metadata(w, mount+"/"+strings.TrimPrefix(rest, "metadata/"))
+	case strings.HasPrefix(rest, "data/"):
+		versions := f.secrets[mount+"/"+strings.TrimPrefix(rest, "data/")]
+		number := len(versions)
+		if v := r.URL.Query().Get("version"); v != "" {
+			number, _ = strconv.Atoi(v)
+		}
+		if number < 1 || number > len(versions) || versions[number-1].deleted || versions[number-1].destroyed {
+			f.reply(w, http.StatusNotFound, nil)
+			return
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{"data": versions[number-1].data, "metadata": map[string]interface{}{"version": number}},
+		})
+	default:
+		f.reply(w, http.StatusNotFound, nil)
+	}
+}
+
+func (f *fakeVault) list(w http.ResponseWriter, mount string, folder string) {
+	prefix := mount + "/" + strings.Trim(folder, "/")
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	entries := map[string]bool{}
+	for secretPath := range f.secrets {
+		if !strings.HasPrefix(secretPath, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(secretPath, prefix)
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		entries[name] = true
+	}
+	if len(entries) == 0 {
+		f.reply(w, http.StatusNotFound, nil)
+		return
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	f.reply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+}
+
+func (f *fakeVault) metadata(w http.ResponseWriter, secretPath string) {
+	versions := f.secrets[secretPath]
+	if len(versions) == 0 {
+		f.reply(w, http.StatusNotFound, nil)
+		return
+	}
+	described := map[string]interface{}{}
+	for i, v := range versions {
+		deletionTime := ""
+		if v.deleted {
+			deletionTime = "2024-02-01T00:00:00Z"
+		}
+		described[strconv.Itoa(i+1)] = map[string]interface{}{
+			"created_time":  "2024-01-01T00:00:00Z",
+			"deletion_time": deletionTime,
+			"destroyed":     v.destroyed,
+		}
+	}
+	f.reply(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+		"current_version": len(versions),
+		"updated_time":    "2024-01-01T00:00:00Z",
+		"versions":        described,
+	}})
+}
+
+func (f *fakeVault) reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body == nil {
+		body = map[string]interface{}{"errors": []string{}}
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Write сохраняет отчёт в формате junit или codequality в файл (или stdout, если файл не задан)
+func (r *Report) Write(format string, output string) error {
+	var w io.Writer = os.Stdout
+	if output != "" {
+		fl, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+		w = fl
+	}
+
+	switch format {
+	case "junit":
+		return r.WriteJUnit(w)
+	case "codequality":
+		return r.WriteCodeQuality(w)
+	default:
+		return errors.New("неизвестный формат отчёта: " + format)
+	}
+}
+
+type junitTestSuites struct {
+	XMLName    xml.Name         `xml:"testsuites"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	TestSuites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit пишет JUnit XML: testsuite на каждый файл, testcase на каждый remoteRef
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suites := junitTestSuites{}
+	suiteIndex := map[string]int{}
+	for _, f := range r.Results {
+		file := reportPath(f.File)
+		idx, found := suiteIndex[file]
+		if !found {
+			idx = len(suites.TestSuites)
+			suiteIndex[file] = idx
+			suites.TestSuites = append(suites.TestSuites, junitTestSuite{Name: file})
+		}
+		testCase := junitTestCase{
+			Name:      f.Key,
+			ClassName: f.Object(),
+			File:      file,
+		}
+		if f.Property != "" {
+			testCase.Name += "/" + f.Property
+		}
+		if f.Failed() && !f.IsError() {
+			// предупреждения не валят тест, но видны в выводе теста
+			testCase.SystemOut = fmt.Sprintf("%s:%d: %s", file, f.Line, f.Description())
+		}
+		if f.IsError() {
+			testCase.Failure = &junitFailure{
+				Message: string(f.Reason),
+				Text:    fmt.Sprintf("%s:%d: %s", file, f.Line, f.Description()),
+			}
+			suites.TestSuites[idx].Failures++
+			suites.Failures++
+		}
+		suites.TestSuites[idx].TestCases = append(suites.TestSuites[idx].TestCases, testCase)
+		suites.TestSuites[idx].Tests++
+		suites.Tests++
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(suites)
+}
+
+// codeQualityIssue - элемент отчёта GitLab Code Quality
+type codeQualityIssue struct {
+	Description string              `json:"description"`
+	CheckName   string              `json:"check_name"`
+	Fingerprint string              `json:"fingerprint"`
+	Severity    string              `json:"severity"`
+	Location    codeQualityLocation `json:"location"`
+}
+
+type codeQualityLocation struct {
+	Path  string `json:"path"`
+	Lines struct {
+		Begin int `json:"begin"`
+	} `json:"lines"`
+}
+
+// WriteCodeQuality пишет отчёт GitLab Code Quality (JSON) только по непрошедшим проверкам
+func (r *Report) WriteCodeQuality(w io.Writer) error {
+	issues := []codeQualityIssue{}
+	for _, f := range r.Failures() {
+		issue := codeQualityIssue{
+			Description: f.Object() + ": " + f.Description(),
+			CheckName:   "eso-vault-secret",
+			Fingerprint: fingerprint(f),
+			Severity:    "critical",
+		}
+		if !f.IsError() {
+			issue.Severity = "minor"
+		}
+		issue.Location.Path = reportPath(f.File)
+		issue.Location.Lines.Begin = f.Line
+		if issue.Location.Lines.Begin < 1 {
+			// для отрендеренных манифестов строка неизвестна - указываем на начало файла
+			issue.Location.Lines.Begin = 1
+		}
+		issues = append(issues, issue)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(issues)
+}
+
+func fingerprint(f Finding) string {
+	parts := []string{f.File, f.ExternalSecret, f.Key, f.Property, string(f.Reason)}
+	if f.Kind != "" {
+		// вид объекта добавлен позже - не меняем отпечатки уже заведённых замечаний по ExternalSecret
+		parts = append(parts, f.Kind)
+	}
+	sum := sha1.Sum([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// reportPath делает путь относительным к текущей папке (корню репозитория в CI), чтобы GitLab смог сопоставить файл
+func reportPath(fileName string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fileName
+	}
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return fileName
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fileName
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Метка, по которой бот находит свою заметку в MR, чтобы править её, а не добавлять новую
+const gitlabNoteMarker = "<!-- check-eso-manifests -->"
+
+// Метка обсуждения на строке: в ней отпечаток замечания, чтобы не открывать одно обсуждение дважды
+var gitlabDiscussionMarker = regexp.MustCompile(`<!-- check-eso-manifests:([0-9a-f]+) -->`)
+
+var gitlabHunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// gitlabClient - запросы к GitLab API от имени бота в рамках одного merge request
+type gitlabClient struct {
+	api     string
+	project string
+	mr      string
+	token   string
+	http    *http.Client
+}
+
+// gitlabClientFromEnv читает CI_API_V4_URL, CI_PROJECT_ID, CI_MERGE_REQUEST_IID и GITLAB_TOKEN (токен с правом api).
+// Вне пайплайна merge request возвращает nil. Без CI_PROJECT_ID или GITLAB_TOKEN - ошибка: публикация пропускается,
+// а результат проверки не меняется
+func gitlabClientFromEnv() (*gitlabClient, error) {
+	mr := getVariable("CI_MERGE_REQUEST_IID", false)
+	if mr == "" {
+		return nil, nil
+	}
+	project := getVariable("CI_PROJECT_ID", false)
+	token := getVariable("GITLAB_TOKEN", false)
+	if project == "" || token == "" {
+		return nil, errors.New("для публикации в merge request нужны переменные CI_PROJECT_ID и GITLAB_TOKEN")
+	}
+	api := getVariable("CI_API_V4_URL", false)
+	if api == "" {
+		api = strings.TrimRight(getVariableOrDefault("CI_SERVER_URL", "https://gitlab.com"), "/") + "/api/v4"
+	}
+	return &gitlabClient{
+		api:     strings.TrimRight(api, "/"),
+		project: project,
+		mr:      mr,
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (c *gitlabClient) mrPath(suffix string) string {
+	return "/projects/" + url.PathEscape(c.project) + "/merge_requests/" + c.mr + suffix
+}
+
+// request выполняет запрос к API. Ответ не 2xx - ошибка
+func (c *gitlabClient) request(method string, path string, payload interface{}) (string, http.Header, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return "", nil, err
+		}
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.api+path, reqBody)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Add("PRIVATE-TOKEN", c.token)
+	if payload != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", nil, errors.New(method + " " + path + ": HTTP " + strconv.Itoa(resp.StatusCode) + " " + gjson.Get(string(body), "message").String())
+	}
+	return string(body), resp.Header, nil
+}
+
+// getAll читает все страницы списка (заголовок X-Next-Page)
+func (c *gitlabClient) getAll(path string) ([]gjson.Result, error) {
+	var items []gjson.Result
+	page := "1"
+	for page != "" {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		body, header, err := c.request("GET", path+separator+"per_page=100&page="+page, nil)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, gjson.Parse(body).Array()...)
+		page = header.Get("X-Next-Page")
+	}
+	return items, nil
+}
+
+// publishGitLabReport публикует результаты в merge request: одна заметка с таблицей замечаний (при повторном запуске
+// она правится) и обсуждения на добавленных в MR строках, где найдены ошибки
+func publishGitLabReport(report *Report) error {
+	client, err := gitlabClientFromEnv()
+	if err != nil {
+		return err
+	}
+	if client == nil {
+		debugOutput("CI_MERGE_REQUEST_IID не задана - это не пайплайн merge request, результаты в GitLab не публикуются")
+		return nil
+	}
+	if err := client.upsertNote(gitlabNoteBody(report)); err != nil {
+		return err
+	}
+	return client.addLineDiscussions(report.SortedFailures())
+}
+
+func (c *gitlabClient) upsertNote(body string) error {
+	notes, err := c.getAll(c.mrPath("/notes?sort=asc"))
+	if err != nil {
+		return err
+	}
+	for _, note := range notes {
+		if strings.Contains(note.Get("body").String(), gitlabNoteMarker) {
+			debugOutput("Обновляем заметку " + note.Get("id").String() + " в merge request !" + c.mr)
+			_, _, err := c.request("PUT", c.mrPath("/notes/"+note.Get("id").String()), map[string]string{"body": body})
+			return err
+		}
+	}
+	debugOutput("Добавляем заметку в merge request !" + c.mr)
+	_, _, err = c.request("POST", c.mrPath("/notes"), map[string]string{"body": body})
+	return err
+}
+
+// addLineDiscussions открывает обсуждения на строках remoteRef, которые добавлены или изменены в MR.
+// Замечания, по которым обсуждение уже открыто (в том числе решённое), повторно не публикуются
+func (c *gitlabClient) addLineDiscussions(findings []Finding) error {
+	body, _, err := c.request("GET", c.mrPath("/versions"), nil)
+	if err != nil {
+		return err
+	}
+	version := gjson.Get(body, "0")
+	if !version.Exists() {
+		return nil
+	}
+
+	diffs, err := c.getAll(c.mrPath("/diffs"))
+	if err != nil {
+		return err
+	}
+	changed := map[string]map[int]bool{}
+	for _, d := range diffs {
+		if !d.Get("deleted_file").Bool() {
+			changed[d.Get("new_path").String()] = addedLines(d.Get("diff").String())
+		}
+	}
+
+	discussions, err := c.getAll(c.mrPath("/discussions"))
+	if err != nil {
+		return err
+	}
+	published := map[string]bool{}
+	for _, discussion := range discussions {
+		for _, note := range discussion.Get("notes").Array() {
+			if m := gitlabDiscussionMarker.FindStringSubmatch(note.Get("body").String()); m != nil {
+				published[m[1]] = true
+			}
+		}
+	}
+
+	root := repositoryRoot(".")
+	for _, f := range findings {
+		if f.Line < 1 || published[fingerprint(f)] {
+			continue
+		}
+		file := repositoryPath(root, f.File)
+		if !changed[file][f.Line] {
+			continue
+		}
+		debugOutput("Открываем обсуждение на " + file + ":" + strconv.Itoa(f.Line))
+		_, _, err := c.request("POST", c.mrPath("/discussions"), map[string]interface{}{
+			"body": fmt.Sprintf("<!-- check-eso-manifests:%s -->\n%s **%s**: %s", fingerprint(f), severityIcon(f), f.Object(), f.Description()),
+			"position": map[string]interface{}{
+				"position_type": "text",
+				"base_sha":      version.Get("base_commit_sha").String(),
+				"start_sha":     version.Get("start_commit_sha").String(),
+				"head_sha":      version.Get("head_commit_sha").String(),
+				"new_path":      file,
+				"new_line":      f.Line,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		published[fingerprint(f)] = true
+	}
+	return nil
+}
+
+// gitlabNoteBody - текст заметки в MR: сводка и таблица замечаний
+func gitlabNoteBody(report *Report) string {
+	findings := report.SortedFailures()
+	var b strings.Builder
+	b.WriteString(gitlabNoteMarker + "\n### Проверка ExternalSecret\n\n")
+	if len(findings) == 0 {
+		fmt.Fprintf(&b, ":white_check_mark: Проверено ссылок на секреты: %d, ошибок не найдено\n", len(report.Results))
+		return b.String()
+	}
+	errorCount := report.ErrorCount()
+	fmt.Fprintf(&b, "Проверено ссылок на секреты: %d, с ошибками: %d, с предупреждениями: %d\n\n", len(report.Results), errorCount, len(findings)-errorCount)
+	b.WriteString("| | Файл | Объект | Замечание |\n| --- | --- | --- | --- |\n")
+	for _, f := range findings {
+		location := reportPath(f.File)
+		if f.Line > 0 {
+			location += ":" + strconv.Itoa(f.Line)
+		}
+		fmt.Fprintf(&b, "| %s | `%s` | %s | %s |\n", severityIcon(f), markdownCell(location), markdownCell(f.Object()), markdownCell(f.Description()))
+	}
+	return b.String()
+}
+
+func severityIcon(f Finding) string {
+	if f.IsError() {
+		return ":x:"
+	}
+	return ":warning:"
+}
+
+func markdownCell(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(value, "|", "\\|"), "\n", " ")
+}
+
+// addedLines возвращает номера добавленных строк нового файла по unified diff из GitLab API
+func addedLines(diff string) map[int]bool {
+	lines := map[int]bool{}
+	newLine := 0
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			if m := gitlabHunkHeader.FindStringSubmatch(line); m != nil {
+				newLine, _ = strconv.Atoi(m[1])
+			}
+		case strings.HasPrefix(line, "+"):
+			lines[newLine] = true
+			newLine++
+		case strings.HasPrefix(line, "-"), strings.HasPrefix(line, "\\"):
+			// удалённая строка или "\ No newline at end of file"
+		default:
+			newLine++
+		}
+	}
+	return lines
+}
+
+// repositoryRoot - корень git репозитория, в котором лежит dir. От него GitLab указывает пути файлов,
+// а Flux - пути локальных чартов. Пустая строка - dir не в git репозитории
+func repositoryRoot(dir string) string {
+	out, err := gitOutput(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+func repositoryPath(root string, file string) string {
+	if root != "" {
+		if abs, err := filepath.Abs(file); err == nil {
+			if rel, err := filepath.Rel(root, abs); err == nil {
+				return filepath.ToSlash(rel)
+			}
+		}
+	}
+	return filepath.ToSlash(reportPath(file))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAddedLines(t *testing.T) {
+	diff := "@@ -1,3 +1,4 @@\n kind: ExternalSecret\n-  name: old\n+  name: db\n+  namespace: app\n spec:\n@@ -20,2 +21,2 @@ spec:\n     remoteRef:\n-      key: app/dbb\n+      key: app/db\n\\ No newline at end of file\n"
+	want := map[int]bool{2: true, 3: true, 22: true}
+	if got := addedLines(diff); !reflect.DeepEqual(got, want) {
+		t.Errorf("addedLines = %v, ожидали %v", got, want)
+	}
+}
+
+// fakeGitLab - заметки и обсуждения одного merge request
+type fakeGitLab struct {
+	mu          sync.Mutex
+	diffPath    string
+	notes       []map[string]interface{}
+	edits       int
+	discussions []map[string]interface{}
+}
+
+func (g *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if r.Header.Get("PRIVATE-TOKEN") != "bot-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	const mr = "/api/v4/projects/42/merge_requests/7"
+	var payload map[string]interface{}
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+	}
+	var reply interface{}
+	switch {
+	case r.Method == "GET" && r.URL.Path == mr+"/notes":
+		reply = g.notes
+	case r.Method == "POST" && r.URL.Path == mr+"/notes":
+		payload["id"] = len(g.notes) + 1
+		g.notes = append(g.notes, payload)
+		reply = payload
+	case r.Method == "PUT" && r.URL.Path == mr+"/notes/1":
+		g.notes[0]["body"] = payload["body"]
+		g.edits++
+		reply = g.notes[0]
+	case r.URL.Path == mr+"/versions":
+		reply = []map[string]string{{"base_commit_sha": "base", "start_commit_sha": "start", "head_commit_sha": "head"}}
+	case r.URL.Path == mr+"/diffs":
+		reply = []map[string]interface{}{{"new_path": g.diffPath, "diff": "@@ -10,2 +10,3 @@\n     remoteRef:\n+      key: app/db\n+      property: DB_USR\n"}}
+	case r.Method == "GET" && r.URL.Path == mr+"/discussions":
+		reply = g.discussions
+	case r.Method == "POST" && r.URL.Path == mr+"/discussions":
+		g.discussions = append(g.discussions, map[string]interface{}{"notes": []interface{}{payload}, "position": payload["position"]})
+		reply = payload
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+func TestPublishGitLabReport(t *testing.T) {
+	file := "apps/app/es.yaml"
+	gitlab := &fakeGitLab{diffPath: repositoryPath(repositoryRoot("."), file)}
+	server := httptest.NewServer(gitlab)
+	defer server.Close()
+	t.Setenv("CI_API_V4_URL", server.URL+"/api/v4")
+	t.Setenv("CI_PROJECT_ID", "42")
+	t.Setenv("CI_MERGE_REQUEST_IID", "7")
+	t.Setenv("GITLAB_TOKEN", "bot-token")
+
+	report := &Report{}
+	report.AddFinding(Finding{File: file, Line: 11, ExternalSecret: "db", Key: "app/db", Property: "DB_USR", Reason: ReasonPropertyNotFound})
+	// строка не изменена в MR - только в таблице
+	report.AddFinding(Finding{File: file, Line: 30, ExternalSecret: "db", Key: "app/cache", Property: "REDIS", Reason: ReasonPathNotFound})
+	for run := 0; run < 2; run++ {
+		if err := publishGitLabReport(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(gitlab.notes) != 1 || gitlab.edits != 1 {
+		t.Fatalf("заметок %d, правок %d: повторный запуск должен править заметку", len(gitlab.notes), gitlab.edits)
+	}
+	body := gitlab.notes[0]["body"].(string)
+	if !strings.Contains(body, gitlabNoteMarker) || !strings.Contains(body, "es.yaml:11") || !strings.Contains(body, "es.yaml:30") {
+		t.Errorf("заметка:\n%s", body)
+	}
+	if len(gitlab.discussions) != 1 {
+		t.Fatalf("обсуждений %d, ожидали одно на изменённой строке", len(gitlab.discussions))
+	}
+	position := gitlab.discussions[0]["position"].(map[string]interface{})
+	if position["new_line"] != float64(11) || position["new_path"] != gitlab.diffPath || position["head_sha"] != "head" {
+		t.Errorf("position: %v", position)
+	}
+}
+
+func TestPublishGitLabReportOutsideMR(t *testing.T) {
+	t.Setenv("CI_MERGE_REQUEST_IID", "")
+	if err := publishGitLabReport(&Report{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublishGitLabReportWithoutToken(t *testing.T) {
+	t.Setenv("CI_MERGE_REQUEST_IID", "7")
+	t.Setenv("CI_PROJECT_ID", "42")
+	t.Setenv("GITLAB_TOKEN", "")
+	if err := publishGitLabReport(&Report{}); err == nil {
+		t.Error("без GITLAB_TOKEN публикация должна возвращать ошибку, а не завершать процесс")
+	}
+}
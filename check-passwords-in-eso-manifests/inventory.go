@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InventoryRow - одна ссылка манифеста на путь Vault
+type InventoryRow struct {
+	File           string `json:"file"`
+	Namespace      string `json:"namespace"`
+	ExternalSecret string `json:"externalSecret"`
+	Target         string `json:"target"`
+	VaultPath      string `json:"vaultPath"`
+	Property       string `json:"property"`
+	Store          string `json:"store"`
+	Version        string `json:"version,omitempty"`
+	UpdatedTime    string `json:"updatedTime,omitempty"`
+
+	store VaultProvider
+	key   string
+}
+
+var inventoryHeader = []string{"Файл", "Namespace", "ExternalSecret", "Secret", "Путь в Vault", "Свойство", "Хранилище", "Версия", "Обновлён"}
+
+func (r InventoryRow) columns() []string {
+	return []string{r.File, r.Namespace, r.ExternalSecret, r.Target, r.VaultPath, r.Property, r.Store, r.Version, r.UpdatedTime}
+}
+
+// runInventory - подкоманда inventory: таблица всех ссылок ExternalSecret на пути Vault.
+// С доступом на чтение метаданных KV v2 добавляются текущая версия и время обновления секрета
+func runInventory(args []string) {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	format := flags.String("format", "csv", "формат: csv, json или markdown")
+	output := flags.String("output", "", "файл для отчёта (по умолчанию stdout)")
+	render := flags.Bool("render", false, "собирать kustomize оверлеи и шаблонизировать локальные Helm чарты из HelmRelease")
+	metadata := flags.Bool("metadata", true, "читать из Vault версию и время обновления секретов (KV v2)")
+	concurrency := flags.Int("concurrency", 8, "число одновременных запросов к Vault")
+	checkError(flags.Parse(args))
+
+	readEnvironment()
+	revokeToken := func() {}
+	if *metadata {
+		revokeToken = setupVault()
+	} else {
+		setDefaultStore()
+	}
+	defer revokeToken()
+
+	report := &Report{}
+	sources, stores := loadSources(*render, report)
+	for _, f := range report.Failures() {
+		debugOutput("!!! " + f.File + ": " + f.Description() + " !!!")
+	}
+
+	var rows []InventoryRow
+	for _, src := range sources {
+		if IsESOManifest(src) {
+			for _, manifest := range decodeExternalSecrets(src) {
+				rows = append(rows, inventoryRows(manifest, stores)...)
+			}
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].File != rows[j].File {
+			return rows[i].File < rows[j].File
+		}
+		return rows[i].ExternalSecret < rows[j].ExternalSecret
+	})
+
+	if *metadata {
+		addInventoryMetadata(rows, *concurrency)
+	}
+
+	checkError(writeInventory(rows, *format, *output))
+	debugOutput("Ссылок на секреты в инвентаризации: " + strconv.Itoa(len(rows)))
+}
+
+// inventoryRows возвращает строки инвентаризации для data и dataFrom одного ExternalSecret
+func inventoryRows(manifest ExternalSecret, stores *StoreIndex) []InventoryRow {
+	ref := manifest.Spec.SecretStoreRef
+	kind := ref.Kind
+	if kind == "" {
+		kind = "SecretStore"
+	}
+	// ошибка Resolve - только отсутствие адреса Vault, путь в таблице от этого не зависит
+	store, _ := stores.Resolve(manifest.Metadata.Namespace, ref)
+
+	base := InventoryRow{
+		File:           reportPath(manifest.File),
+		Namespace:      manifest.Metadata.Namespace,
+		ExternalSecret: manifest.Metadata.Name,
+		Target:         targetName(manifest),
+		Store:          kind + "/" + ref.Name,
+		store:          store,
+	}
+	vaultPath := func(key string) string {
+		mount, secretPath := store.SplitKey(key)
+		return path.Clean(mount + "/" + secretPath)
+	}
+
+	var rows []InventoryRow
+	for _, v := range manifest.Spec.Data {
+		row := base
+		row.VaultPath = vaultPath(v.RemoteRef.Key)
+		row.Property = v.RemoteRef.Property
+		row.key = v.RemoteRef.Key
+		rows = append(rows, row)
+	}
+	for _, v := range manifest.Spec.DataFrom {
+		row := base
+		switch {
+		case v.Extract != nil:
+			row.VaultPath = vaultPath(v.Extract.Key)
+			row.Property = v.Extract.Property
+			if row.Property == "" {
+				row.Property = "*"
+			}
+			row.key = v.Extract.Key
+		case v.Find != nil:
+			row.VaultPath = vaultPath(v.Find.Path) + "/"
+			row.Property = strings.TrimPrefix(v.Describe(), "dataFrom.")
+		default:
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// addInventoryMetadata дописывает текущую версию и время обновления секретов KV v2. Без доступа поля остаются пустыми
+func addInventoryMetadata(rows []InventoryRow, concurrency int) {
+	pool := newWorkerPool(concurrency)
+	for i := range rows {
+		if rows[i].key == "" || rows[i].store.Server == "" {
+			continue
+		}
+		i := i
+		pool.Go(func() {
+			metadata, ok := readVaultMetadata(rows[i].store, rows[i].key)
+			if !ok {
+				return
+			}
+			// каждая задача пишет только в свою строку
+			rows[i].Version = metadata.Get("current_version").String()
+			rows[i].UpdatedTime = metadata.Get("updated_time").String()
+		})
+	}
+	pool.Wait()
+}
+
+func writeInventory(rows []InventoryRow, format string, output string) error {
+	var w io.Writer = os.Stdout
+	if output != "" {
+		fl, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+		w = fl
+	}
+
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		if err := writer.Write(inventoryHeader); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := writer.Write(row.columns()); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "json":
+		if rows == nil {
+			rows = []InventoryRow{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case "markdown":
+		fmt.Fprintln(w, "| "+strings.Join(inventoryHeader, " | ")+" |")
+		fmt.Fprintln(w, strings.Repeat("| --- ", len(inventoryHeader))+"|")
+		for _, row := range rows {
+			columns := row.columns()
+			for i, c := range columns {
+				columns[i] = strings.ReplaceAll(c, "|", "\\|")
+			}
+			fmt.Fprintln(w, "| "+strings.Join(columns, " | ")+" |")
+		}
+		return nil
+	default:
+		return errors.New("неизвестный формат инвентаризации: " + format + " (csv, json или markdown)")
+	}
+}
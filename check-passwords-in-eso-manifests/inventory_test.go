@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testInventoryRows(t *testing.T) []InventoryRow {
+	t.Helper()
+	_, kv2, _ := testVault(t)
+	src := ManifestSource{File: "apps/app/db.yaml", Content: []byte(`apiVersion: external-secrets.io/v1beta1
+kind: SecretStore
+metadata:
+  name: vault
+  namespace: app
+spec:
+  provider:
+    vault:
+      server: ` + kv2.Server + `
+      path: bd
+---
+apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  target:
+    name: db-credentials
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+  dataFrom:
+  - extract:
+      key: app/config
+  - find:
+      path: app
+      name:
+        regexp: "^c"
+`)}
+	stores := NewStoreIndex()
+	stores.LoadSource(src)
+	rows := inventoryRows(decodeExternalSecrets(src)[0], stores)
+	addInventoryMetadata(rows, 2)
+	return rows
+}
+
+func TestInventoryRows(t *testing.T) {
+	rows := testInventoryRows(t)
+	want := []struct{ path, property, version string }{
+		{"bd/app/db", "DB_PASSWORD", "1"},
+		{"bd/app/config", "*", "1"},
+		{"bd/app/", "find path=app name=^c", ""},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("строки: %+v", rows)
+	}
+	for i, w := range want {
+		row := rows[i]
+		if row.VaultPath != w.path || row.Property != w.property || row.Version != w.version {
+			t.Errorf("строка %d: %+v, ожидали %+v", i, row, w)
+		}
+		if row.Namespace != "app" || row.Target != "db-credentials" || row.Store != "SecretStore/vault" {
+			t.Errorf("строка %d: %+v", i, row)
+		}
+	}
+	if rows[0].UpdatedTime == "" {
+		t.Error("нет времени обновления секрета")
+	}
+}
+
+func TestWriteInventory(t *testing.T) {
+	rows := testInventoryRows(t)
+	rows[0].Property = "a|b"
+	dir := t.TempDir()
+	read := func(format string) string {
+		file := filepath.Join(dir, "inventory."+format)
+		if err := writeInventory(rows, format, file); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(read("csv"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[0][4] != "Путь в Vault" || records[1][5] != "a|b" {
+		t.Errorf("csv: %v", records)
+	}
+
+	var decoded []map[string]string
+	if err := json.Unmarshal([]byte(read("json")), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 3 || decoded[0]["vaultPath"] != "bd/app/db" || decoded[0]["version"] != "1" {
+		t.Errorf("json: %v", decoded)
+	}
+	if _, found := decoded[2]["version"]; found {
+		t.Errorf("пустая версия должна опускаться: %v", decoded[2])
+	}
+
+	lines := strings.Split(strings.TrimSpace(read("markdown")), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[1], "| --- ") || !strings.Contains(lines[2], "a\\|b") {
+		t.Errorf("markdown:\n%s", strings.Join(lines, "\n"))
+	}
+
+	if writeInventory(nil, "xml", filepath.Join(dir, "inventory.xml")) == nil {
+		t.Error("неизвестный формат должен давать ошибку")
+	}
+	empty := filepath.Join(dir, "empty.json")
+	if err := writeInventory(nil, "json", empty); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(empty); strings.TrimSpace(string(content)) != "[]" {
+		t.Errorf("пустая инвентаризация в json: %s", content)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lintRule - правило проверки самого манифеста ExternalSecret, без обращения к Vault
+type lintRule struct {
+	Name     string
+	Reason   FailureReason
+	Severity Severity
+}
+
+const lintOff = "off"
+
+var (
+	ruleRefreshInterval = lintRule{"refresh-interval", ReasonRefreshInterval, SeverityError}
+	ruleDuplicateKey    = lintRule{"duplicate-secret-key", ReasonDuplicateKey, SeverityError}
+	ruleDuplicateTarget = lintRule{"duplicate-target", ReasonDuplicateTarget, SeverityError}
+	ruleNoStoreRef      = lintRule{"missing-store-ref", ReasonNoStoreRef, SeverityError}
+	ruleAPIVersion      = lintRule{"unsupported-api-version", ReasonAPIVersion, SeverityWarning}
+)
+
+var lintRules = []lintRule{ruleRefreshInterval, ruleDuplicateKey, ruleDuplicateTarget, ruleNoStoreRef, ruleAPIVersion}
+
+// Версии API ExternalSecret, которые понимает установленный в кластерах ESO
+var supportedAPIVersions = map[string]bool{
+	"external-secrets.io/v1beta1": true,
+	"external-secrets.io/v1":      true,
+}
+
+// validateLintConfig проверяет имена правил и значения серьёзности из раздела lint файла настроек
+func validateLintConfig(lint map[string]string) error {
+	known := map[string]bool{}
+	for _, rule := range lintRules {
+		known[rule.Name] = true
+	}
+	for name, severity := range lint {
+		if !known[name] {
+			return errors.New("неизвестное правило lint: " + name)
+		}
+		if severity != string(SeverityError) && severity != string(SeverityWarning) && severity != lintOff {
+			return errors.New("правило lint " + name + ": серьёзность должна быть error, warning или off, а не " + severity)
+		}
+	}
+	return nil
+}
+
+// severity возвращает серьёзность правила с учётом файла настроек. false - правило отключено
+func (r lintRule) severity() (Severity, bool) {
+	configured, found := config.Lint[r.Name]
+	if !found {
+		return r.Severity, true
+	}
+	if configured == lintOff {
+		return "", false
+	}
+	return Severity(configured), true
+}
+
+func (r lintRule) add(report *Report, manifest ExternalSecret, line int, key string, details string) {
+	severity, enabled := r.severity()
+	if !enabled {
+		return
+	}
+	debugOutput("!!! [Lint!] ---> " + manifest.Metadata.Name + ": " + string(r.Reason) + " " + details + " !!!")
+	report.AddFinding(Finding{
+		File:           manifest.File,
+		Line:           line,
+		Kind:           manifest.ReportKind(),
+		ExternalSecret: manifest.Metadata.Name,
+		Key:            key,
+		Reason:         r.Reason,
+		Severity:       severity,
+		Details:        r.Name + ": " + details,
+	})
+}
+
+// lintExternalSecrets проверяет манифесты ExternalSecret правилами lint.
+// checked - какие манифесты проверять (в режиме --since только из изменённых файлов), все манифесты нужны для поиска дубликатов
+func lintExternalSecrets(manifests []ExternalSecret, checked func(ExternalSecret) bool, report *Report) {
+	targets := map[string][]ExternalSecret{}
+	for _, manifest := range manifests {
+		targets[targetIdentity(manifest)] = append(targets[targetIdentity(manifest)], manifest)
+	}
+
+	for _, manifest := range manifests {
+		if !checked(manifest) {
+			continue
+		}
+		spec := manifest.Spec
+
+		if !supportedAPIVersions[manifest.APIVersion] {
+			ruleAPIVersion.add(report, manifest, manifest.Line, "apiVersion", manifest.APIVersion)
+		}
+		if spec.RefreshInterval != "" {
+			if _, err := time.ParseDuration(spec.RefreshInterval); err != nil {
+				ruleRefreshInterval.add(report, manifest, manifest.Line, "refreshInterval", spec.RefreshInterval)
+			}
+		}
+		if spec.SecretStoreRef.Name == "" {
+			ruleNoStoreRef.add(report, manifest, manifest.Line, "secretStoreRef", "ESO не сможет выбрать хранилище")
+		}
+
+		seen := map[string]bool{}
+		for _, v := range spec.Data {
+			if seen[v.SecretKey] {
+				ruleDuplicateKey.add(report, manifest, v.RemoteRef.Line, "secretKey", v.SecretKey)
+			}
+			seen[v.SecretKey] = true
+		}
+
+		if others := targets[targetIdentity(manifest)]; len(others) > 1 {
+			var names []string
+			for _, other := range others {
+				if other.File != manifest.File || other.Metadata.Name != manifest.Metadata.Name {
+					names = append(names, other.Metadata.Name+" ("+other.File+")")
+				}
+			}
+			sort.Strings(names)
+			ruleDuplicateTarget.add(report, manifest, manifest.Line, "target "+targetName(manifest), "также создаётся в "+strings.Join(names, ", "))
+		}
+	}
+}
+
+func targetName(manifest ExternalSecret) string {
+	if manifest.Spec.Target.Name != "" {
+		return manifest.Spec.Target.Name
+	}
+	// ESO по умолчанию называет Secret как ExternalSecret
+	return manifest.Metadata.Name
+}
+
+// targetIdentity - namespace и имя целевого Secret. Если namespace не указан (его проставит kustomize или Flux),
+// дубликатами считаются только манифесты из одной папки
+func targetIdentity(manifest ExternalSecret) string {
+	namespace := manifest.Metadata.Namespace
+	if namespace == "" {
+		namespace = "dir:" + filepath.Dir(manifest.File)
+	}
+	return namespace + "/" + targetName(manifest)
+}
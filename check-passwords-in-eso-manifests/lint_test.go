@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+const lintManifests = `apiVersion: external-secrets.io/v1alpha1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  refreshInterval: 1 hour
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASS
+`
+
+// lintFindings возвращает серьёзность замечаний lint по причинам
+func lintFindings(t *testing.T, lint map[string]string) map[FailureReason]Severity {
+	t.Helper()
+	previous := config
+	config.Lint = lint
+	t.Cleanup(func() { config = previous })
+
+	report := &Report{}
+	manifests := decodeExternalSecrets(ManifestSource{File: "apps/app/db.yaml", Content: []byte(lintManifests)})
+	lintExternalSecrets(manifests, func(ExternalSecret) bool { return true }, report)
+	found := map[FailureReason]Severity{}
+	for _, f := range report.Failures() {
+		found[f.Reason] = f.Severity
+	}
+	return found
+}
+
+func TestLintSeverityDefaults(t *testing.T) {
+	found := lintFindings(t, nil)
+	want := map[FailureReason]Severity{
+		ReasonAPIVersion:      SeverityWarning,
+		ReasonRefreshInterval: SeverityError,
+		ReasonNoStoreRef:      SeverityError,
+		ReasonDuplicateKey:    SeverityError,
+	}
+	if len(found) != len(want) {
+		t.Fatalf("замечания: %v", found)
+	}
+	for reason, severity := range want {
+		if found[reason] != severity {
+			t.Errorf("%s: %q, ожидали %q", reason, found[reason], severity)
+		}
+	}
+}
+
+func TestLintSeverityOverrides(t *testing.T) {
+	lint := map[string]string{
+		"unsupported-api-version": "error",
+		"refresh-interval":        "warning",
+		"missing-store-ref":       "off",
+	}
+	if err := validateLintConfig(lint); err != nil {
+		t.Fatal(err)
+	}
+	found := lintFindings(t, lint)
+	if found[ReasonAPIVersion] != SeverityError || found[ReasonRefreshInterval] != SeverityWarning || found[ReasonDuplicateKey] != SeverityError {
+		t.Errorf("серьёзность с учётом настроек: %v", found)
+	}
+	if _, reported := found[ReasonNoStoreRef]; reported {
+		t.Error("отключённое правило не должно давать замечаний")
+	}
+}
+
+func TestValidateLintConfig(t *testing.T) {
+	for _, lint := range []map[string]string{
+		{"no-such-rule": "error"},
+		{"refresh-interval": "fatal"},
+	} {
+		if validateLintConfig(lint) == nil {
+			t.Errorf("%v: ожидали ошибку", lint)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestSource - набор YAML документов: файл репозитория или результат рендера kustomize/Helm.
+// Для отрендеренных манифестов File - путь к kustomization.yaml или HelmRelease, из которого они получены
+type ManifestSource struct {
+	File     string
+	Content  []byte
+	Rendered bool
+}
+
+func (src ManifestSource) HasKind(signatures ...string) bool {
+	for _, signature := range signatures {
+		if strings.Contains(string(src.Content), signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSources читает файлы манифестов с диска как есть
+func readSources(files []string) []ManifestSource {
+	var sources []ManifestSource
+	for _, fileName := range files {
+		fl, err := ioutil.ReadFile(fileName)
+		checkError(err)
+		sources = append(sources, ManifestSource{File: fileName, Content: fl})
+	}
+	return sources
+}
+
+// decodeExternalSecrets возвращает все ExternalSecret из документов манифеста, в том числе
+// спецификации ExternalSecret из ClusterExternalSecret
+func decodeExternalSecrets(src ManifestSource) []ExternalSecret {
+	var manifests []ExternalSecret
+	dec := yaml.NewDecoder(bytes.NewReader(src.Content))
+	for {
+		var doc yaml.Node
+		if dec.Decode(&doc) != nil {
+			break
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		var manifest ExternalSecret
+		switch scalarValue(mappingValue(doc.Content[0], "kind")) {
+		case "ExternalSecret":
+			if doc.Decode(&manifest) != nil {
+				continue
+			}
+		case "ClusterExternalSecret":
+			var cluster ClusterExternalSecret
+			if doc.Decode(&cluster) != nil {
+				continue
+			}
+			manifest = cluster.ExternalSecret()
+		default:
+			continue
+		}
+		manifest.File = src.File
+		if src.Rendered {
+			// строки отрендеренного манифеста не соответствуют строкам файлов репозитория
+			manifest.ClearLines()
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests
+}
+
+// ExternalSecret - поля манифеста ExternalSecret, которые нужны для проверки
+type ExternalSecret struct {
+	File       string `yaml:"-"`
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec ExternalSecretSpec `yaml:"spec"`
+	// Line - строка в YAML файле, с которой начинается документ
+	Line int `yaml:"-"`
+}
+
+func (m *ExternalSecret) UnmarshalYAML(value *yaml.Node) error {
+	type plain ExternalSecret
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	m.Line = value.Line
+	return nil
+}
+
+// ReportKind - вид объекта для Finding.Kind: пустой для ExternalSecret, чтобы не менять отпечатки замечаний
+func (m ExternalSecret) ReportKind() string {
+	if m.Kind == "ExternalSecret" {
+		return ""
+	}
+	return m.Kind
+}
+
+// ClusterExternalSecret - ExternalSecret, который ESO создаёт в каждом namespace из namespaceSelector/namespaces
+type ClusterExternalSecret struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		// ExternalSecretName - имя создаваемых ExternalSecret, по умолчанию имя ClusterExternalSecret
+		ExternalSecretName string             `yaml:"externalSecretName"`
+		ExternalSecretSpec ExternalSecretSpec `yaml:"externalSecretSpec"`
+	} `yaml:"spec"`
+	Line int `yaml:"-"`
+}
+
+func (c *ClusterExternalSecret) UnmarshalYAML(value *yaml.Node) error {
+	type plain ClusterExternalSecret
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.Line = value.Line
+	return nil
+}
+
+// ExternalSecret возвращает проверяемый ExternalSecret. Namespace пустой: ExternalSecret создаётся в нескольких namespace,
+// SecretStore ищется по имени, целевые Secret сопоставляются с нагрузками из той же папки
+func (c ClusterExternalSecret) ExternalSecret() ExternalSecret {
+	manifest := ExternalSecret{APIVersion: c.APIVersion, Kind: c.Kind, Spec: c.Spec.ExternalSecretSpec, Line: c.Line}
+	manifest.Metadata.Name = c.Metadata.Name
+	if manifest.Spec.Target.Name == "" && c.Spec.ExternalSecretName != "" {
+		// ESO называет Secret как созданный ExternalSecret
+		manifest.Spec.Target.Name = c.Spec.ExternalSecretName
+	}
+	return manifest
+}
+
+// Identity - kind/namespace/name, по которым ExternalSecret сопоставляется между ревизиями и окружениями
+func (m ExternalSecret) Identity() string {
+	return m.Kind + "/" + m.Metadata.Namespace + "/" + m.Metadata.Name
+}
+
+// ClearLines обнуляет номера строк - для манифестов, у которых нет соответствующего файла в репозитории
+func (m *ExternalSecret) ClearLines() {
+	m.Line = 0
+	for i := range m.Spec.Data {
+		m.Spec.Data[i].RemoteRef.Line = 0
+	}
+	for i := range m.Spec.DataFrom {
+		m.Spec.DataFrom[i].Line = 0
+		if m.Spec.DataFrom[i].Extract != nil {
+			m.Spec.DataFrom[i].Extract.Line = 0
+		}
+	}
+	if m.Spec.Target.Template != nil {
+		m.Spec.Target.Template.Line = 0
+	}
+}
+
+type ExternalSecretSpec struct {
+	RefreshInterval string                   `yaml:"refreshInterval"`
+	SecretStoreRef  SecretStoreRef           `yaml:"secretStoreRef"`
+	Target          ExternalSecretTarget     `yaml:"target"`
+	Data            []ExternalSecretData     `yaml:"data"`
+	DataFrom        []ExternalSecretDataFrom `yaml:"dataFrom"`
+}
+
+type ExternalSecretTarget struct {
+	Name     string          `yaml:"name"`
+	Template *TargetTemplate `yaml:"template"`
+}
+
+// TargetTemplate - spec.target.template. Line - строка в YAML файле, где описан шаблон
+type TargetTemplate struct {
+	Data map[string]string `yaml:"data"`
+	// MergePolicy - Replace (по умолчанию, в Secret только ключи шаблона) или Merge
+	MergePolicy string `yaml:"mergePolicy"`
+	Line        int    `yaml:"-"`
+}
+
+func (t *TargetTemplate) UnmarshalYAML(value *yaml.Node) error {
+	type plain TargetTemplate
+	if err := value.Decode((*plain)(t)); err != nil {
+		return err
+	}
+	t.Line = value.Line
+	return nil
+}
+
+type ExternalSecretData struct {
+	SecretKey string    `yaml:"secretKey"`
+	RemoteRef RemoteRef `yaml:"remoteRef"`
+}
+
+// RemoteRef - ссылка на секрет в Vault. Line - строка в YAML файле, где описан remoteRef
+type RemoteRef struct {
+	Key      string `yaml:"key"`
+	Property string `yaml:"property"`
+	Version  string `yaml:"version"`
+	Line     int    `yaml:"-"`
+}
+
+func (r *RemoteRef) UnmarshalYAML(value *yaml.Node) error {
+	type plain RemoteRef
+	if err := value.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	r.Line = value.Line
+	return nil
+}
+
+// ExternalSecretDataFrom - элемент spec.dataFrom: extract (секрет целиком) или find (поиск секретов)
+type ExternalSecretDataFrom struct {
+	Extract *RemoteRef              `yaml:"extract"`
+	Find    *ExternalSecretFind     `yaml:"find"`
+	Rewrite []ExternalSecretRewrite `yaml:"rewrite"`
+	Line    int                     `yaml:"-"`
+}
+
+func (d *ExternalSecretDataFrom) UnmarshalYAML(value *yaml.Node) error {
+	type plain ExternalSecretDataFrom
+	if err := value.Decode((*plain)(d)); err != nil {
+		return err
+	}
+	d.Line = value.Line
+	return nil
+}
+
+// Describe - короткое описание элемента dataFrom для отчёта
+func (d ExternalSecretDataFrom) Describe() string {
+	switch {
+	case d.Extract != nil:
+		return "dataFrom.extract " + d.Extract.Key
+	case d.Find != nil:
+		description := "dataFrom.find"
+		if d.Find.Path != "" {
+			description += " path=" + d.Find.Path
+		}
+		if d.Find.Name != nil {
+			description += " name=" + d.Find.Name.RegExp
+		}
+		return description
+	default:
+		return "dataFrom"
+	}
+}
+
+type ExternalSecretFind struct {
+	Path string `yaml:"path"`
+	Name *struct {
+		RegExp string `yaml:"regexp"`
+	} `yaml:"name"`
+	Tags map[string]string `yaml:"tags"`
+}
+
+type ExternalSecretRewrite struct {
+	Regexp *struct {
+		Source string `yaml:"source"`
+		Target string `yaml:"target"`
+	} `yaml:"regexp"`
+	Transform *struct {
+		Template string `yaml:"template"`
+	} `yaml:"transform"`
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestDecodeExternalSecrets(t *testing.T) {
+	src := ManifestSource{File: "es.yaml", Content: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+---
+apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+    kind: ClusterSecretStore
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+      version: "2"
+  dataFrom:
+  - extract:
+      key: app/shared
+  - find:
+      path: app
+      name:
+        regexp: "^db-"
+`)}
+
+	manifests := decodeExternalSecrets(src)
+	if len(manifests) != 1 {
+		t.Fatalf("ожидали один ExternalSecret, получили %d", len(manifests))
+	}
+	m := manifests[0]
+	if m.File != "es.yaml" || m.Line != 6 || m.Metadata.Namespace != "app" || m.Spec.SecretStoreRef.Kind != "ClusterSecretStore" {
+		t.Errorf("манифест: %+v", m)
+	}
+	if len(m.Spec.Data) != 1 {
+		t.Fatalf("data: %+v", m.Spec.Data)
+	}
+	ref := m.Spec.Data[0].RemoteRef
+	if ref.Key != "app/db" || ref.Property != "DB_PASSWORD" || ref.Version != "2" || ref.Line != 18 {
+		t.Errorf("remoteRef: %+v", ref)
+	}
+	if len(m.Spec.DataFrom) != 2 || m.Spec.DataFrom[0].Extract == nil || m.Spec.DataFrom[1].Find == nil {
+		t.Fatalf("dataFrom: %+v", m.Spec.DataFrom)
+	}
+	if got := m.Spec.DataFrom[1].Describe(); got != "dataFrom.find path=app name=^db-" {
+		t.Errorf("Describe() = %q", got)
+	}
+
+	src.Rendered = true
+	if rendered := decodeExternalSecrets(src)[0]; rendered.Line != 0 || rendered.Spec.Data[0].RemoteRef.Line != 0 {
+		t.Errorf("у отрендеренного манифеста не должно быть строк: %+v", rendered)
+	}
+}
+
+func TestDecodeClusterExternalSecret(t *testing.T) {
+	src := ManifestSource{File: "cluster/db.yaml", Content: []byte(`apiVersion: external-secrets.io/v1beta1
+kind: ClusterExternalSecret
+metadata:
+  name: shared-db
+spec:
+  externalSecretName: db
+  namespaceSelector:
+    matchLabels:
+      team: payments
+  externalSecretSpec:
+    secretStoreRef:
+      name: vault
+      kind: ClusterSecretStore
+    data:
+    - secretKey: password
+      remoteRef:
+        key: shared/db
+        property: DB_PASSWORD
+`)}
+	if !IsESOManifest(src) {
+		t.Fatal("ClusterExternalSecret не распознан как манифест ESO")
+	}
+	manifests := decodeExternalSecrets(src)
+	if len(manifests) != 1 {
+		t.Fatalf("ожидали один ExternalSecret, получили %d", len(manifests))
+	}
+	m := manifests[0]
+	if m.ReportKind() != "ClusterExternalSecret" || m.Metadata.Name != "shared-db" || targetName(m) != "db" || m.Line != 1 {
+		t.Errorf("манифест: %+v", m)
+	}
+	if len(m.Spec.Data) != 1 || m.Spec.Data[0].RemoteRef.Key != "shared/db" || m.Spec.Data[0].RemoteRef.Line != 17 {
+		t.Errorf("data: %+v", m.Spec.Data)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// OrphansConfig - где искать секреты, на которые не ссылается ни один манифест (подкоманда orphans)
+type OrphansConfig struct {
+	// Prefixes - пути вместе с mount, например bd/apps/. По умолчанию - все mount, на которые есть ссылки в манифестах
+	Prefixes []string `yaml:"prefixes"`
+}
+
+// OrphanSecret - секрет или свойство секрета в Vault, которые не используются манифестами
+type OrphanSecret struct {
+	VaultPath   string `json:"vaultPath"`
+	Property    string `json:"property,omitempty"`
+	Version     string `json:"version,omitempty"`
+	UpdatedTime string `json:"updatedTime,omitempty"`
+}
+
+// vaultReferences - пути и свойства Vault, которые используют манифесты репозитория
+type vaultReferences struct {
+	// путь -> свойства. nil - секрет используется целиком (dataFrom.extract, remoteRef без property)
+	properties map[string]map[string]bool
+	// dataFrom.find: папка и регулярное выражение имени
+	finds []vaultFind
+	// mount -> хранилище, через которое он читается
+	mounts map[string]VaultProvider
+}
+
+type vaultFind struct {
+	mount  string
+	folder string
+	name   *regexp.Regexp
+}
+
+func (r *vaultReferences) addProperty(secretPath string, property string) {
+	properties, found := r.properties[secretPath]
+	if found && properties == nil {
+		return
+	}
+	if property == "" {
+		r.properties[secretPath] = nil
+		return
+	}
+	if properties == nil {
+		properties = map[string]bool{}
+		r.properties[secretPath] = properties
+	}
+	// property запоминается как есть: ключ верхнего уровня определяется по данным секрета в usedKeys
+	properties[property] = true
+}
+
+// usedKeys возвращает ключи верхнего уровня секрета, на которые ссылаются свойства. Как и ESO, свойство - это
+// сначала ключ целиком (tls.crt), и только если такого ключа нет - путь gjson во вложенный JSON (database.host)
+func usedKeys(secret map[string]gjson.Result, properties map[string]bool) map[string]bool {
+	keys := map[string]bool{}
+	for property := range properties {
+		if _, found := secret[property]; found {
+			keys[property] = true
+			continue
+		}
+		keys[gjsonFirstKey(property)] = true
+	}
+	return keys
+}
+
+// gjsonFirstKey - первый ключ пути gjson с учётом экранированных точек (tls\.crt.value -> tls.crt)
+func gjsonFirstKey(property string) string {
+	var key strings.Builder
+	for i := 0; i < len(property); i++ {
+		switch {
+		case property[i] == '\\' && i+1 < len(property):
+			i++
+			key.WriteByte(property[i])
+		case property[i] == '.':
+			return key.String()
+		default:
+			key.WriteByte(property[i])
+		}
+	}
+	return key.String()
+}
+
+// foundByFind - попадает ли секрет под один из dataFrom.find
+func (r *vaultReferences) foundByFind(secretPath string) bool {
+	for _, find := range r.finds {
+		if !strings.HasPrefix(secretPath, path.Join(find.mount, find.folder)+"/") {
+			continue
+		}
+		// как и ESO, регулярное выражение применяется к пути относительно mount
+		if find.name == nil || find.name.MatchString(strings.TrimPrefix(secretPath, find.mount+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitKey делит ключ на mount и путь и запоминает хранилище, через которое читается mount
+func (r *vaultReferences) splitKey(store VaultProvider, key string) (string, string) {
+	mount, secretPath := store.SplitKey(key)
+	if _, found := r.mounts[mount]; !found {
+		r.mounts[mount] = store
+	}
+	return mount, secretPath
+}
+
+func (r *vaultReferences) fullPath(store VaultProvider, key string) string {
+	mount, secretPath := r.splitKey(store, key)
+	return path.Clean(mount + "/" + secretPath)
+}
+
+// collectVaultReferences собирает все пути и свойства Vault из ExternalSecret и пути, в которые пишут PushSecret
+func collectVaultReferences(manifests []ExternalSecret, pushSecrets []PushSecret, stores *StoreIndex) *vaultReferences {
+	refs := &vaultReferences{properties: map[string]map[string]bool{}, mounts: map[string]VaultProvider{}}
+	for _, manifest := range manifests {
+		store, _ := stores.Resolve(manifest.Metadata.Namespace, manifest.Spec.SecretStoreRef)
+		for _, v := range manifest.Spec.Data {
+			refs.addProperty(refs.fullPath(store, v.RemoteRef.Key), v.RemoteRef.Property)
+		}
+		for _, v := range manifest.Spec.DataFrom {
+			switch {
+			case v.Extract != nil:
+				refs.addProperty(refs.fullPath(store, v.Extract.Key), v.Extract.Property)
+			case v.Find != nil:
+				mount, folder := refs.splitKey(store, v.Find.Path)
+				find := vaultFind{mount: mount, folder: strings.Trim(folder, "/")}
+				if v.Find.Name != nil {
+					re, err := regexp.Compile(v.Find.Name.RegExp)
+					if err != nil {
+						continue
+					}
+					find.name = re
+				}
+				refs.finds = append(refs.finds, find)
+			}
+		}
+	}
+	for _, manifest := range pushSecrets {
+		for _, ref := range manifest.Spec.SecretStoreRefs {
+			if ref.Name == "" {
+				// хранилища по labelSelector не разрешаются
+				continue
+			}
+			store, _ := stores.Resolve(manifest.Metadata.Namespace, ref)
+			for _, v := range manifest.Spec.Data {
+				if v.Match.RemoteRef.RemoteKey != "" {
+					// без property PushSecret записывает Secret целиком
+					refs.addProperty(refs.fullPath(store, v.Match.RemoteRef.RemoteKey), v.Match.RemoteRef.Property)
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// loadReferenceManifests возвращает ExternalSecret и PushSecret из манифестов - всё, что ссылается на пути Vault
+func loadReferenceManifests(sources []ManifestSource) ([]ExternalSecret, []PushSecret) {
+	var manifests []ExternalSecret
+	var pushSecrets []PushSecret
+	for _, src := range sources {
+		if IsESOManifest(src) {
+			manifests = append(manifests, decodeExternalSecrets(src)...)
+		}
+		if src.HasKind("kind: PushSecret") {
+			pushSecrets = append(pushSecrets, decodePushSecrets(src)...)
+		}
+	}
+	return manifests, pushSecrets
+}
+
+// runOrphans - подкоманда orphans: обходит папки Vault через LIST и находит секреты и свойства,
+// на которые не ссылается ни один манифест. Нужен токен с правами list и read
+func runOrphans(args []string) {
+	flags := flag.NewFlagSet("orphans", flag.ExitOnError)
+	format := flags.String("format", "text", "формат: text, csv или json")
+	output := flags.String("output", "", "файл для отчёта в формате csv/json (по умолчанию stdout)")
+	render := flags.Bool("render", false, "собирать kustomize оверлеи и шаблонизировать локальные Helm чарты из HelmRelease")
+	configFile := flags.String("config", "", "YAML файл настроек (раздел orphans.prefixes)")
+	prefixes := flags.String("prefixes", "", "пути Vault через запятую вместо orphans.prefixes, например bd/apps/,bd/shared/")
+	concurrency := flags.Int("concurrency", 8, "число одновременных запросов к Vault")
+	checkError(flags.Parse(args))
+
+	readEnvironment()
+	if err := loadConfig(*configFile); err != nil {
+		log.Fatal("Не удалось прочитать файл настроек " + *configFile + ": " + err.Error())
+	}
+	revokeToken := setupVault()
+	defer revokeToken()
+
+	report := &Report{}
+	sources, stores := loadSources(*render, report)
+	if len(report.Failures()) > 0 {
+		// без части манифестов живые секреты окажутся в списке неиспользуемых
+		report.Print()
+		revokeToken()
+		log.Fatal("Не удалось отрендерить все манифесты - список неиспользуемых секретов был бы неполным")
+	}
+	manifests, pushSecrets := loadReferenceManifests(sources)
+	refs := collectVaultReferences(manifests, pushSecrets, stores)
+
+	roots := config.Orphans.Prefixes
+	if *prefixes != "" {
+		roots = strings.Split(*prefixes, ",")
+	}
+	secrets, storeOf, err := walkVaultPrefixes(vaultRoots(roots, refs), refs)
+	if err != nil {
+		revokeToken()
+		log.Fatal(err)
+	}
+	orphans := findOrphans(secrets, storeOf, refs, *concurrency)
+	checkError(writeOrphans(orphans, *format, *output))
+}
+
+// vaultRoots - папки Vault для обхода. Если они не заданы - все mount, на которые ссылаются манифесты
+func vaultRoots(roots []string, refs *vaultReferences) []string {
+	if len(roots) > 0 {
+		return roots
+	}
+	for mount := range refs.mounts {
+		roots = append(roots, mount+"/")
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// walkVaultPrefixes рекурсивно обходит папки roots (пути вместе с mount) и возвращает отсортированные пути секретов
+// вместе с mount и хранилище, через которое читается каждый путь
+func walkVaultPrefixes(roots []string, refs *vaultReferences) ([]string, map[string]VaultProvider, error) {
+	var secrets []string
+	storeOf := map[string]VaultProvider{}
+	for _, root := range roots {
+		root = strings.Trim(strings.TrimSpace(root), "/")
+		parts := strings.SplitN(root, "/", 2)
+		mount, folder := parts[0], ""
+		if len(parts) == 2 {
+			folder = parts[1]
+		}
+		store, found := refs.mounts[mount]
+		if !found {
+			store = defaultStore
+			store.Path = mount
+		}
+		if store.Server == "" {
+			store.Server = vaultAddr
+		}
+		if store.Version == "" {
+			store.Version = "v2"
+		}
+		debugOutput("Обходим " + mount + "/" + folder + " в " + store.Server)
+		listed, reason, details := listVaultSecretsRecursive(store, mount, folder)
+		if reason != "" {
+			return nil, nil, errors.New("не удалось получить список секретов " + root + ": " + string(reason) + " " + details)
+		}
+		for _, secretPath := range listed {
+			fullPath := mount + "/" + secretPath
+			secrets = append(secrets, fullPath)
+			storeOf[fullPath] = store
+		}
+	}
+	sort.Strings(secrets)
+	return secrets, storeOf, nil
+}
+
+// findOrphans сравнивает секреты из Vault со ссылками манифестов
+func findOrphans(secrets []string, storeOf map[string]VaultProvider, refs *vaultReferences, concurrency int) []OrphanSecret {
+	orphans := make([][]OrphanSecret, len(secrets))
+	pool := newWorkerPool(concurrency)
+	for i, fullPath := range secrets {
+		properties, referenced := refs.properties[fullPath]
+		if referenced && properties == nil || refs.foundByFind(fullPath) {
+			continue
+		}
+		i, fullPath := i, fullPath
+		store := storeOf[fullPath]
+		pool.Go(func() {
+			orphans[i] = secretOrphans(store, fullPath, properties, referenced)
+		})
+	}
+	pool.Wait()
+
+	var result []OrphanSecret
+	for _, o := range orphans {
+		result = append(result, o...)
+	}
+	debugOutput("Секретов в Vault: " + strconv.Itoa(len(secrets)) + ", неиспользуемых секретов и свойств: " + strconv.Itoa(len(result)))
+	return result
+}
+
+// secretOrphans возвращает весь секрет, если на него нет ссылок, или его неиспользуемые свойства
+func secretOrphans(store VaultProvider, fullPath string, used map[string]bool, referenced bool) []OrphanSecret {
+	orphan := OrphanSecret{VaultPath: fullPath}
+	if metadata, ok := readVaultMetadata(store, fullPath); ok {
+		orphan.Version = metadata.Get("current_version").String()
+		orphan.UpdatedTime = metadata.Get("updated_time").String()
+	}
+	if !referenced {
+		return []OrphanSecret{orphan}
+	}
+
+	secret, reason, _ := readVaultSecret(store, fullPath, "")
+	if reason != "" {
+		debugOutput("---> Не удалось прочитать " + fullPath + ": " + string(reason))
+		return nil
+	}
+	data := secret.Map()
+	keys := usedKeys(data, used)
+	var orphans []OrphanSecret
+	for property := range data {
+		if !keys[property] {
+			o := orphan
+			o.Property = property
+			orphans = append(orphans, o)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Property < orphans[j].Property })
+	return orphans
+}
+
+func writeOrphans(orphans []OrphanSecret, format string, output string) error {
+	if format == "text" {
+		for _, o := range orphans {
+			what := "секрет не используется"
+			if o.Property != "" {
+				what = "свойство " + o.Property + " не используется"
+			}
+			if o.UpdatedTime != "" {
+				what += ", обновлён " + o.UpdatedTime + ", версия " + o.Version
+			}
+			log.Println("[Orphan] " + o.VaultPath + ": " + what)
+		}
+		return nil
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		fl, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+		w = fl
+	}
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"Путь в Vault", "Свойство", "Версия", "Обновлён"}); err != nil {
+			return err
+		}
+		for _, o := range orphans {
+			if err := writer.Write([]string{o.VaultPath, o.Property, o.Version, o.UpdatedTime}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "json":
+		if orphans == nil {
+			orphans = []OrphanSecret{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(orphans)
+	default:
+		return errors.New("неизвестный формат: " + format + " (text, csv или json)")
+	}
+}
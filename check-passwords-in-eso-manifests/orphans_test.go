@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testOrphans(t *testing.T, manifest string) []string {
+	t.Helper()
+	vault, kv2, _ := testVault(t)
+	vault.put("bd/app/tls", map[string]interface{}{"tls.crt": "c", "tls.key": "k", "ca.crt": "ca"})
+	vault.put("bd/app/unused", map[string]interface{}{"A": "a"})
+	vault.put("bd/jobs/cleanup", map[string]interface{}{"TOKEN": "t"})
+	vault.put("bd/push/db", map[string]interface{}{"DB_PASSWORD": "p", "DB_USER": "u"})
+	vault.put("bd/push/cache", map[string]interface{}{"REDIS": "r"})
+
+	src := ManifestSource{File: "apps/app/es.yaml", Content: []byte(`apiVersion: external-secrets.io/v1beta1
+kind: SecretStore
+metadata:
+  name: vault
+  namespace: app
+spec:
+  provider:
+    vault:
+      server: ` + kv2.Server + `
+      path: bd
+---
+` + manifest)}
+	stores := NewStoreIndex()
+	stores.LoadSource(src)
+	manifests, pushSecrets := loadReferenceManifests([]ManifestSource{src})
+	refs := collectVaultReferences(manifests, pushSecrets, stores)
+	secrets, storeOf, err := walkVaultPrefixes(vaultRoots(nil, refs), refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orphans []string
+	for _, o := range findOrphans(secrets, storeOf, refs, 2) {
+		orphans = append(orphans, strings.TrimSuffix(o.VaultPath+"#"+o.Property, "#"))
+	}
+	return orphans
+}
+
+func TestFindOrphans(t *testing.T) {
+	orphans := testOrphans(t, `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: app
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+  - secretKey: host
+    remoteRef:
+      key: app/config
+      property: database.host
+  - secretKey: tls.crt
+    remoteRef:
+      key: app/tls
+      property: tls.crt
+  - secretKey: ca.crt
+    remoteRef:
+      key: app/tls
+      property: ca\.crt
+  dataFrom:
+  - extract:
+      key: app/rotated
+  - find:
+      path: jobs
+      name:
+        regexp: "^jobs/clean"
+`)
+	// tls.key не используется, хотя tls.crt с той же частью до точки используется
+	want := "bd/app/db#DB_USER,bd/app/tls#tls.key,bd/app/unused,bd/push/cache,bd/push/db"
+	if got := strings.Join(orphans, ","); got != want {
+		t.Errorf("неиспользуемые: %s, ожидали %s", got, want)
+	}
+}
+
+func TestGjsonFirstKey(t *testing.T) {
+	for property, want := range map[string]string{
+		"DB_PASSWORD":    "DB_PASSWORD",
+		"database.host":  "database",
+		`tls\.crt.value`: "tls.crt",
+		`a\\.b`:          `a\`,
+		"trailing\\":     "trailing\\",
+	} {
+		if got := gjsonFirstKey(property); got != want {
+			t.Errorf("gjsonFirstKey(%q) = %q, ожидали %q", property, got, want)
+		}
+	}
+}
+
+func TestFindOrphansPushSecret(t *testing.T) {
+	orphans := testOrphans(t, `apiVersion: external-secrets.io/v1alpha1
+kind: PushSecret
+metadata:
+  name: push
+  namespace: app
+spec:
+  secretStoreRefs:
+  - name: vault
+  selector:
+    secret:
+      name: db
+  data:
+  - match:
+      secretKey: password
+      remoteRef:
+        remoteKey: push/db
+        property: DB_PASSWORD
+  - match:
+      secretKey: redis
+      remoteRef:
+        remoteKey: push/cache
+`)
+	// секреты, в которые пишет PushSecret, используются: целиком без property или только указанное свойство
+	for _, orphan := range orphans {
+		if orphan == "bd/push/cache" || orphan == "bd/push/db#DB_PASSWORD" || orphan == "bd/push/db" {
+			t.Errorf("путь PushSecret считается неиспользуемым: %v", orphans)
+		}
+	}
+	found := false
+	for _, orphan := range orphans {
+		found = found || orphan == "bd/push/db#DB_USER"
+	}
+	if !found {
+		t.Errorf("свойство, в которое PushSecret не пишет, должно быть неиспользуемым: %v", orphans)
+	}
+}
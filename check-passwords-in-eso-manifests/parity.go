@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ParityConfig - настройки режима --parity: сравнение ExternalSecret одного приложения в разных окружениях
+type ParityConfig struct {
+	// Environments - имена папок окружений в пути манифеста (по умолчанию dev, stage, prod)
+	Environments []string `yaml:"environments"`
+	// Reference - окружение, свойства Vault которого должны быть и в остальных окружениях (по умолчанию первое)
+	Reference string `yaml:"reference"`
+	// NamespacePattern - регулярное выражение, первая группа которого - namespace приложения без окружения.
+	// По умолчанию из namespace убирается имя окружения: payments-prod -> payments
+	NamespacePattern string `yaml:"namespacePattern"`
+
+	namespaceRegexp *regexp.Regexp
+}
+
+// Проверять ли одинаковость ExternalSecret в окружениях
+var checkParity bool
+
+func (c *ParityConfig) setDefaults() error {
+	if len(c.Environments) == 0 {
+		c.Environments = []string{"dev", "stage", "prod"}
+	}
+	if c.Reference == "" {
+		c.Reference = c.Environments[0]
+	}
+	if c.NamespacePattern != "" {
+		re, err := regexp.Compile(c.NamespacePattern)
+		if err != nil {
+			return errors.New("parity.namespacePattern: " + err.Error())
+		}
+		c.namespaceRegexp = re
+	}
+	return nil
+}
+
+// environmentOf возвращает окружение по папке манифеста. Пустая строка - манифест не относится ни к одному окружению
+func (c ParityConfig) environmentOf(file string) string {
+	for _, segment := range strings.Split(filepath.ToSlash(filepath.Dir(reportPath(file))), "/") {
+		for _, env := range c.Environments {
+			if segment == env {
+				return env
+			}
+		}
+	}
+	return ""
+}
+
+// appIdentity - имя ExternalSecret и namespace без окружения, по которым сопоставляются манифесты окружений
+func (c ParityConfig) appIdentity(manifest ExternalSecret, env string) string {
+	namespace := manifest.Metadata.Namespace
+	if c.namespaceRegexp != nil {
+		if m := c.namespaceRegexp.FindStringSubmatch(namespace); len(m) > 1 {
+			namespace = m[1]
+		}
+	} else {
+		var parts []string
+		for _, part := range strings.Split(namespace, "-") {
+			if part != env {
+				parts = append(parts, part)
+			}
+		}
+		namespace = strings.Join(parts, "-")
+	}
+	return namespace + "/" + manifest.Metadata.Name
+}
+
+// staticKeys - ключи целевого Secret, известные без обращения к Vault: secretKey из data и ключи шаблона
+func staticKeys(manifest ExternalSecret) map[string]int {
+	keys := map[string]int{}
+	if template := manifest.Spec.Target.Template; template != nil && len(template.Data) > 0 {
+		for k := range template.Data {
+			keys[k] = template.Line
+		}
+		if template.MergePolicy != "Merge" {
+			return keys
+		}
+	}
+	for _, v := range manifest.Spec.Data {
+		keys[v.SecretKey] = v.RemoteRef.Line
+	}
+	return keys
+}
+
+// checkEnvironmentParity группирует ExternalSecret по приложению и сообщает о ключах, которые есть в одном окружении,
+// но отсутствуют в другом. Для ключей, которых нет в окружении, свойство из эталонного окружения ищется в Vault
+// по пути с заменой имени окружения (bd/dev/app -> bd/prod/app). Ключи dataFrom не сравниваются
+func checkEnvironmentParity(manifests []ExternalSecret, stores *StoreIndex, pool *workerPool, checked func(ExternalSecret) bool, report *Report) {
+	parity := config.Parity
+	apps := map[string]map[string]ExternalSecret{}
+	for _, manifest := range manifests {
+		env := parity.environmentOf(manifest.File)
+		if env == "" {
+			continue
+		}
+		identity := parity.appIdentity(manifest, env)
+		if apps[identity] == nil {
+			apps[identity] = map[string]ExternalSecret{}
+		}
+		if first, found := apps[identity][env]; found {
+			// сравнивается первый манифест, о повторе сообщаем, чтобы расхождения не терялись молча
+			if checked(first) || checked(manifest) {
+				report.AddFinding(Finding{
+					File:           manifest.File,
+					Line:           manifest.Line,
+					Kind:           manifest.ReportKind(),
+					ExternalSecret: manifest.Metadata.Name,
+					Key:            "parity",
+					Reason:         ReasonParityDuplicate,
+					Details:        "окружение " + env + ", уже описано в " + reportPath(first.File) + ", сравнивается только оно",
+				})
+			}
+			continue
+		}
+		apps[identity][env] = manifest
+	}
+
+	for _, byEnv := range apps {
+		anyChanged := false
+		for _, manifest := range byEnv {
+			anyChanged = anyChanged || checked(manifest)
+		}
+		if !anyChanged {
+			continue
+		}
+
+		var missingEnvs []string
+		keyEnvs := map[string][]string{}
+		for _, env := range parity.Environments {
+			manifest, found := byEnv[env]
+			if !found {
+				missingEnvs = append(missingEnvs, env)
+				continue
+			}
+			for k := range staticKeys(manifest) {
+				keyEnvs[k] = append(keyEnvs[k], env)
+			}
+		}
+		if len(missingEnvs) > 0 {
+			some := anyManifest(byEnv, parity.Environments)
+			report.AddFinding(Finding{
+				File:           some.File,
+				Line:           some.Line,
+				Kind:           some.ReportKind(),
+				ExternalSecret: some.Metadata.Name,
+				Key:            "parity",
+				Reason:         ReasonParityMissingApp,
+				Details:        "нет в " + strings.Join(missingEnvs, ", "),
+			})
+		}
+
+		for env, manifest := range byEnv {
+			keys := staticKeys(manifest)
+			for _, k := range sortedKeys(keySet(keyEnvs)) {
+				if _, found := keys[k]; found {
+					continue
+				}
+				report.AddFinding(Finding{
+					File:           manifest.File,
+					Line:           manifest.Line,
+					Kind:           manifest.ReportKind(),
+					ExternalSecret: manifest.Metadata.Name,
+					Key:            "secretKey",
+					Property:       k,
+					Reason:         ReasonParityMissingKey,
+					Details:        "окружение " + env + ", ключ есть в " + strings.Join(keyEnvs[k], ", "),
+				})
+			}
+		}
+
+		reference, found := byEnv[parity.Reference]
+		if !found {
+			continue
+		}
+		for env, manifest := range byEnv {
+			if env != parity.Reference {
+				checkParityVaultProperties(reference, manifest, env, stores, pool, report)
+			}
+		}
+	}
+}
+
+// checkParityVaultProperties ищет в Vault окружения env свойства, на которые ссылается эталонное окружение,
+// для ключей, которых нет в ExternalSecret окружения env
+func checkParityVaultProperties(reference ExternalSecret, manifest ExternalSecret, env string, stores *StoreIndex, pool *workerPool, report *Report) {
+	store, err := stores.Resolve(manifest.Metadata.Namespace, manifest.Spec.SecretStoreRef)
+	if err != nil {
+		return
+	}
+	keys := staticKeys(manifest)
+	for _, v := range reference.Spec.Data {
+		if _, found := keys[v.SecretKey]; found {
+			// ссылка окружения проверяется основной проверкой
+			continue
+		}
+		segments := strings.Split(v.RemoteRef.Key, "/")
+		replaced := false
+		for i, segment := range segments {
+			if segment == config.Parity.Reference {
+				segments[i] = env
+				replaced = true
+			}
+		}
+		if !replaced {
+			continue
+		}
+		key := strings.Join(segments, "/")
+		ref := v.RemoteRef
+		pool.Go(func() {
+			debugOutput("---> Паритет окружений: ищем " + ref.Key + "/" + ref.Property + " в " + store.SecretURL(key))
+			ok, reason, details := isSecretInVaultExists(store, key, ref.Property, "")
+			if ok {
+				return
+			}
+			if details != "" {
+				details = ", " + details
+			}
+			report.AddFinding(Finding{
+				File:           manifest.File,
+				Line:           manifest.Line,
+				Kind:           manifest.ReportKind(),
+				ExternalSecret: manifest.Metadata.Name,
+				Key:            key,
+				Property:       ref.Property,
+				Reason:         ReasonParityVaultMissing,
+				Details:        "окружение " + env + ", в " + config.Parity.Reference + " берётся из " + ref.Key + ": " + string(reason) + details,
+			})
+		})
+	}
+}
+
+func anyManifest(byEnv map[string]ExternalSecret, envs []string) ExternalSecret {
+	for _, env := range envs {
+		if manifest, found := byEnv[env]; found {
+			return manifest
+		}
+	}
+	return ExternalSecret{}
+}
+
+func keySet(keyEnvs map[string][]string) map[string]bool {
+	keys := map[string]bool{}
+	for k := range keyEnvs {
+		keys[k] = true
+	}
+	return keys
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func parityManifest(namespace string, keys ...string) string {
+	manifest := `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: payments
+  namespace: ` + namespace + `
+spec:
+  secretStoreRef:
+    kind: ClusterSecretStore
+    name: vault
+  data:
+`
+	for _, key := range keys {
+		manifest += "  - secretKey: " + key + "\n    remoteRef:\n      key: bd/dev/payments\n      property: " + key + "\n"
+	}
+	return manifest
+}
+
+func TestCheckEnvironmentParity(t *testing.T) {
+	vault, kv2, _ := testVault(t)
+	vault.put("bd/prod/payments", map[string]interface{}{"DB_PASSWORD": "p"})
+	previous := config
+	config.Parity = ParityConfig{Environments: []string{"dev", "stage", "prod"}}
+	if err := config.Parity.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { config = previous })
+
+	stores := NewStoreIndex()
+	stores.LoadSource(ManifestSource{File: "clusters/store.yaml", Content: []byte(`apiVersion: external-secrets.io/v1beta1
+kind: ClusterSecretStore
+metadata:
+  name: vault
+spec:
+  provider:
+    vault:
+      server: ` + kv2.Server + `
+      path: bd
+`)})
+
+	var manifests []ExternalSecret
+	for file, content := range map[string]string{
+		"apps/dev/payments.yaml":  parityManifest("payments-dev", "DB_PASSWORD", "API_TOKEN"),
+		"apps/prod/payments.yaml": parityManifest("payments-prod", "DB_PASSWORD"),
+		// тот же ExternalSecret в prod второй раз - с другим набором ключей
+		"apps/prod/z/payments.yaml": parityManifest("payments-prod", "DB_PASSWORD", "API_TOKEN"),
+		"apps/other/payments.yaml":  parityManifest("payments", "OTHER"),
+	} {
+		manifests = append(manifests, decodeExternalSecrets(ManifestSource{File: file, Content: []byte(content)})...)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].File < manifests[j].File })
+
+	report := &Report{}
+	pool := newWorkerPool(2)
+	checkEnvironmentParity(manifests, stores, pool, func(ExternalSecret) bool { return true }, report)
+	pool.Wait()
+
+	found := map[FailureReason]Finding{}
+	for _, f := range report.Failures() {
+		if _, duplicate := found[f.Reason]; duplicate {
+			t.Errorf("повторное замечание: %+v", f)
+		}
+		found[f.Reason] = f
+	}
+	if len(found) != 4 {
+		t.Errorf("замечания: %+v", report.Failures())
+	}
+	if f := found[ReasonParityMissingApp]; f.Details != "нет в stage" {
+		t.Errorf("нет окружения: %+v", f)
+	}
+	if f := found[ReasonParityMissingKey]; f.File != "apps/prod/payments.yaml" || f.Property != "API_TOKEN" {
+		t.Errorf("нет ключа: %+v", f)
+	}
+	if f := found[ReasonParityVaultMissing]; f.Key != "bd/prod/payments" || f.Property != "API_TOKEN" {
+		t.Errorf("нет свойства в Vault: %+v", f)
+	}
+	if f := found[ReasonParityDuplicate]; f.File != "apps/prod/z/payments.yaml" || f.Severity != SeverityWarning {
+		t.Errorf("повтор в окружении: %+v", f)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Известные форматы токенов, которые не должны попадать в репозиторий
+var knownTokens = []struct {
+	Name   string
+	Regexp *regexp.Regexp
+}{
+	{"токен Vault", regexp.MustCompile(`\bhv[sbr]\.[A-Za-z0-9_-]{20,}`)},
+	{"токен GitLab", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+	{"ключ доступа AWS", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"приватный ключ", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+}
+
+// Порог энтропии Шеннона (бит на символ) и минимальная длина строки, похожей на пароль
+const (
+	entropyThreshold = 4.0
+	entropyMinLength = 20
+)
+
+// Allowlist - известные ложные срабатывания сканера открытых секретов. Строки файла:
+//
+//	<файл>               - весь файл, допускаются шаблоны filepath.Match
+//	<файл>:<ключ>        - ключ в файле, например apps/app/secret.yaml:data.TLS_CA (выводится в отчёте)
+//
+// Пустые строки и строки, начинающиеся с #, пропускаются. Записи не зависят от значения,
+// чтобы ни отчёт, ни allowlist не раскрывали сам секрет
+type Allowlist struct {
+	patterns []string
+}
+
+func loadAllowlist(path string) (*Allowlist, error) {
+	allowlist := &Allowlist{}
+	if path == "" {
+		return allowlist, nil
+	}
+	fl, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+
+	scanner := bufio.NewScanner(fl)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			allowlist.patterns = append(allowlist.patterns, line)
+		}
+	}
+	return allowlist, scanner.Err()
+}
+
+// Allowed - разрешён ли ключ key из файла
+func (a *Allowlist) Allowed(file string, key string) bool {
+	file = allowlistPath(file)
+	for _, pattern := range a.patterns {
+		filePattern, keyPattern := pattern, ""
+		if i := strings.LastIndex(pattern, ":"); i > 0 {
+			filePattern, keyPattern = pattern[:i], pattern[i+1:]
+		}
+		if matched, _ := filepath.Match(filePattern, file); !matched {
+			continue
+		}
+		if keyPattern == "" || keyPattern == key {
+			return true
+		}
+	}
+	return false
+}
+
+func allowlistPath(file string) string {
+	return filepath.ToSlash(reportPath(file))
+}
+
+// shannonEntropy - энтропия строки в битах на символ
+func shannonEntropy(value string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range value {
+		counts[r]++
+		total++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// classifyValue проверяет значение на известные форматы токенов и высокую энтропию.
+// Пустая причина - значение не похоже на секрет
+func classifyValue(value string) (FailureReason, string) {
+	for _, token := range knownTokens {
+		if token.Regexp.MatchString(value) {
+			return ReasonKnownToken, token.Name
+		}
+	}
+	value = strings.TrimSpace(value)
+	if len(value) < entropyMinLength || strings.ContainsAny(value, " \t\n") || strings.Contains(value, "://") {
+		return "", ""
+	}
+	if !strings.ContainsAny(value, "0123456789") || strings.ToLower(value) == value && strings.ToUpper(value) == value {
+		return "", ""
+	}
+	if entropy := shannonEntropy(value); entropy >= entropyThreshold {
+		return ReasonHighEntropy, ""
+	}
+	return "", ""
+}
+
+// scanPlaintextSecrets ищет секреты в открытом виде: Secret с data/stringData,
+// а также токены и строки с высокой энтропией в ConfigMap и переменных окружения контейнеров
+func scanPlaintextSecrets(src ManifestSource, allowlist *Allowlist, report *Report) {
+	dec := yaml.NewDecoder(bytes.NewReader(src.Content))
+	for {
+		var doc yaml.Node
+		if dec.Decode(&doc) != nil {
+			break
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		root := doc.Content[0]
+		kind := scalarValue(mappingValue(root, "kind"))
+		name := scalarValue(mappingValue(mappingValue(root, "metadata"), "name"))
+
+		scanner := plaintextScanner{src: src, kind: kind, name: name, allowlist: allowlist, report: report}
+		switch kind {
+		case "Secret":
+			if mappingValue(root, "sops") != nil {
+				// зашифрован SOPS - Flux расшифрует его при применении
+				continue
+			}
+			scanner.secretData(mappingValue(root, "data"), "data")
+			scanner.secretData(mappingValue(root, "stringData"), "stringData")
+		case "ConfigMap":
+			data := mappingValue(root, "data")
+			if data != nil && data.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(data.Content); i += 2 {
+					scanner.value(data.Content[i], "data."+data.Content[i].Value, data.Content[i+1].Value)
+				}
+			}
+		}
+		scanner.env(root)
+	}
+}
+
+type plaintextScanner struct {
+	src       ManifestSource
+	kind      string
+	name      string
+	allowlist *Allowlist
+	report    *Report
+}
+
+func (s plaintextScanner) add(node *yaml.Node, key string, reason FailureReason, details string) {
+	if s.allowlist.Allowed(s.src.File, key) {
+		return
+	}
+	line := node.Line
+	if s.src.Rendered {
+		line = 0
+	}
+	if details != "" {
+		details += ", "
+	}
+	details += "запись для allowlist: " + allowlistPath(s.src.File) + ":" + key
+	tag := "[Fail!]"
+	if warningReasons[reason] {
+		tag = "[Warn!]"
+	}
+	debugOutput("!!! " + tag + " ---> " + s.kind + " " + s.name + " " + key + ": " + string(reason) + " !!!")
+	s.report.AddFinding(Finding{
+		File:           s.src.File,
+		Line:           line,
+		Kind:           s.kind,
+		ExternalSecret: s.name,
+		Key:            key,
+		Reason:         reason,
+		Details:        details,
+	})
+}
+
+// secretData отмечает каждый непустой ключ data/stringData объекта Secret
+func (s plaintextScanner) secretData(data *yaml.Node, field string) {
+	if data == nil || data.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(data.Content); i += 2 {
+		value := data.Content[i+1].Value
+		if value == "" || strings.HasPrefix(value, "ENC[") {
+			continue
+		}
+		s.add(data.Content[i], field+"."+data.Content[i].Value, ReasonPlaintextSecret, "используйте ExternalSecret")
+	}
+}
+
+func (s plaintextScanner) value(node *yaml.Node, key string, value string) {
+	if reason, details := classifyValue(value); reason != "" {
+		s.add(node, key, reason, details)
+	}
+}
+
+// env обходит документ и проверяет значения всех списков env вида {name, value}
+func (s plaintextScanner) env(node *yaml.Node) {
+	if node.Kind != yaml.MappingNode && node.Kind != yaml.SequenceNode {
+		return
+	}
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "env" && node.Content[i+1].Kind == yaml.SequenceNode {
+				for _, item := range node.Content[i+1].Content {
+					value := mappingValue(item, "value")
+					if value != nil && value.Kind == yaml.ScalarNode {
+						s.value(value, "env."+scalarValue(mappingValue(item, "name")), value.Value)
+					}
+				}
+				continue
+			}
+			s.env(node.Content[i+1])
+		}
+		return
+	}
+	for _, item := range node.Content {
+		s.env(item)
+	}
+}
+
+// mappingValue возвращает значение ключа YAML словаря или nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PathPolicy - какие пути Vault разрешено читать ExternalSecret из namespace или папки репозитория (файл --policy):
+//
+//	default: deny
+//	rules:
+//	- namespace: "team-*"
+//	  allow: ["bd/{namespace}/", "bd/shared/*/public"]
+//	- dir: apps/legacy/
+//	  allow: ["bd/legacy/"]
+//
+// Элемент allow без * ? [ - префикс пути, иначе шаблон path.Match (* не захватывает /).
+// {namespace} заменяется на namespace ExternalSecret. Пути указываются вместе с mount.
+// Правила namespace не подходят к манифестам без namespace (ClusterExternalSecret, namespace из kustomize без --render):
+// для них нужно правило dir, иначе ссылки запрещаются независимо от default
+type PathPolicy struct {
+	// Default - allow (по умолчанию) или deny для ExternalSecret, к которым не подходит ни одно правило
+	Default string           `yaml:"default"`
+	Rules   []PathPolicyRule `yaml:"rules"`
+}
+
+type PathPolicyRule struct {
+	// Namespace - шаблон path.Match для namespace ExternalSecret
+	Namespace string `yaml:"namespace"`
+	// Dir - папка репозитория (относительно текущей папки), в которой лежит манифест
+	Dir   string   `yaml:"dir"`
+	Allow []string `yaml:"allow"`
+}
+
+func loadPathPolicy(file string) (*PathPolicy, error) {
+	if file == "" {
+		return nil, nil
+	}
+	fl, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var policy PathPolicy
+	if err := yaml.Unmarshal(fl, &policy); err != nil {
+		return nil, err
+	}
+	if policy.Default == "" {
+		policy.Default = "allow"
+	}
+	if policy.Default != "allow" && policy.Default != "deny" {
+		return nil, errors.New("default должен быть allow или deny, а не " + policy.Default)
+	}
+	for _, rule := range policy.Rules {
+		if rule.Namespace == "" && rule.Dir == "" {
+			return nil, errors.New("в правиле политики нужно указать namespace или dir")
+		}
+		for _, pattern := range append([]string{rule.Namespace}, rule.Allow...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New("некорректный шаблон " + pattern + ": " + err.Error())
+			}
+		}
+	}
+	return &policy, nil
+}
+
+func (r PathPolicyRule) matches(manifest ExternalSecret) bool {
+	if r.Namespace != "" {
+		if manifest.Metadata.Namespace == "" {
+			return false
+		}
+		if matched, _ := path.Match(r.Namespace, manifest.Metadata.Namespace); !matched {
+			return false
+		}
+	}
+	if r.Dir != "" {
+		dir := strings.Trim(filepath.ToSlash(r.Dir), "/") + "/"
+		if !strings.HasPrefix(filepath.ToSlash(reportPath(manifest.File)), dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowedPaths возвращает разрешённые для ExternalSecret пути. Второе значение false - ни одно правило не подошло
+func (p *PathPolicy) AllowedPaths(manifest ExternalSecret) ([]string, bool) {
+	var allowed []string
+	found := false
+	for _, rule := range p.Rules {
+		if !rule.matches(manifest) {
+			continue
+		}
+		found = true
+		for _, pattern := range rule.Allow {
+			allowed = append(allowed, strings.ReplaceAll(pattern, "{namespace}", manifest.Metadata.Namespace))
+		}
+	}
+	return allowed, found
+}
+
+func pathAllowed(secretPath string, allowed []string) bool {
+	for _, pattern := range allowed {
+		pattern = strings.TrimLeft(pattern, "/")
+		if !strings.ContainsAny(pattern, "*?[") {
+			if secretPath == strings.TrimSuffix(pattern, "/") || strings.HasPrefix(secretPath, strings.TrimSuffix(pattern, "/")+"/") {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, secretPath); matched {
+			return true
+		}
+		// шаблон папки разрешает и всё, что в ней лежит
+		parts := strings.Split(secretPath, "/")
+		for i := len(parts) - 1; i > 0; i-- {
+			if matched, _ := path.Match(pattern, strings.Join(parts[:i], "/")); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPathPolicy отклоняет ссылки remoteRef, dataFrom.extract и dataFrom.find, которые ведут за пределы путей,
+// разрешённых политикой для namespace или папки ExternalSecret. Наличие секрета в Vault не важно
+func checkPathPolicy(manifests []ExternalSecret, stores *StoreIndex, policy *PathPolicy, checked func(ExternalSecret) bool, report *Report) {
+	for _, manifest := range manifests {
+		if !checked(manifest) {
+			continue
+		}
+		allowed, found := policy.AllowedPaths(manifest)
+		if !found && policy.Default == "allow" && manifest.Metadata.Namespace != "" {
+			continue
+		}
+		// ошибка Resolve - только отсутствие адреса Vault, а для проверки пути нужен лишь mount
+		store, _ := stores.Resolve(manifest.Metadata.Namespace, manifest.Spec.SecretStoreRef)
+
+		check := func(line int, description string, key string, property string) {
+			mount, secretPath := store.SplitKey(key)
+			fullPath := path.Clean(mount + "/" + secretPath)
+			if pathAllowed(fullPath, allowed) {
+				return
+			}
+			details := "разрешены: " + strings.Join(allowed, ", ")
+			switch {
+			case !found && manifest.Metadata.Namespace == "":
+				details = "namespace не указан, а правил dir для папки манифеста нет"
+			case !found:
+				details = "для namespace " + manifest.Metadata.Namespace + " нет правил, по умолчанию доступ запрещён"
+			}
+			debugOutput("!!! [Fail!] ---> " + manifest.Metadata.Name + ": путь " + fullPath + " запрещён политикой !!!")
+			report.AddFinding(Finding{
+				File:           manifest.File,
+				Line:           line,
+				Kind:           manifest.ReportKind(),
+				ExternalSecret: manifest.Metadata.Name,
+				Key:            description,
+				Property:       property,
+				Reason:         ReasonPathNotAllowed,
+				Details:        fullPath + ", " + details,
+			})
+		}
+
+		for _, v := range manifest.Spec.Data {
+			check(v.RemoteRef.Line, v.RemoteRef.Key, v.RemoteRef.Key, v.RemoteRef.Property)
+		}
+		for _, v := range manifest.Spec.DataFrom {
+			switch {
+			case v.Extract != nil:
+				check(v.Line, v.Describe(), v.Extract.Key, v.Extract.Property)
+			case v.Find != nil:
+				check(v.Line, v.Describe(), v.Find.Path, "")
+			}
+		}
+	}
+}
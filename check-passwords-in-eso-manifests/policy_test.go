@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `rules:
+- namespace: "team-*"
+  allow: ["bd/{namespace}/", "bd/shared/*/public"]
+- dir: apps/legacy/
+  allow: ["bd/legacy/"]
+`
+
+func loadTestPolicy(t *testing.T, policy string) *PathPolicy {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(file, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadPathPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+// policyViolations возвращает ключи remoteRef, запрещённые политикой
+func policyViolations(policy *PathPolicy, file string, manifest string) []string {
+	report := &Report{}
+	manifests := decodeExternalSecrets(ManifestSource{File: file, Content: []byte(manifest)})
+	checkPathPolicy(manifests, NewStoreIndex(), policy, func(ExternalSecret) bool { return true }, report)
+	var keys []string
+	for _, f := range report.Failures() {
+		keys = append(keys, f.Key)
+	}
+	return keys
+}
+
+func policyManifest(kind string, namespace string, keys ...string) string {
+	manifest := "apiVersion: external-secrets.io/v1beta1\nkind: " + kind + "\nmetadata:\n  name: app\n"
+	if namespace != "" {
+		manifest += "  namespace: " + namespace + "\n"
+	}
+	spec := "  secretStoreRef:\n    name: vault\n  data:\n"
+	for _, key := range keys {
+		spec += "  - secretKey: " + filepath.Base(key) + "\n    remoteRef:\n      key: " + key + "\n"
+	}
+	if kind == "ClusterExternalSecret" {
+		return manifest + "spec:\n  externalSecretSpec:\n  " + strings.ReplaceAll(strings.TrimSuffix(spec, "\n"), "\n", "\n  ") + "\n"
+	}
+	return manifest + "spec:\n" + spec
+}
+
+func TestPathPolicyRules(t *testing.T) {
+	policy := loadTestPolicy(t, testPolicy)
+	for _, tc := range []struct {
+		name     string
+		file     string
+		manifest string
+		want     []string
+	}{
+		{"{namespace} и шаблон", "apps/team/es.yaml", policyManifest("ExternalSecret", "team-a", "bd/team-a/db", "bd/shared/x/public/key", "bd/shared/x/private", "bd/team-b/db", "bd/team-abc"), []string{"bd/shared/x/private", "bd/team-b/db", "bd/team-abc"}},
+		{"правило dir", "apps/legacy/es.yaml", policyManifest("ExternalSecret", "legacy", "bd/legacy/db", "bd/team-a/db"), []string{"bd/team-a/db"}},
+		{"нет правил, default allow", "apps/other/es.yaml", policyManifest("ExternalSecret", "other", "bd/anything"), nil},
+		// без namespace правила namespace не подходят, а default allow не применяется
+		{"ExternalSecret без namespace", "apps/team/es.yaml", policyManifest("ExternalSecret", "", "bd/team-a/db"), []string{"bd/team-a/db"}},
+		{"ClusterExternalSecret", "apps/team/ces.yaml", policyManifest("ClusterExternalSecret", "", "bd/shared/x/public"), []string{"bd/shared/x/public"}},
+		{"ClusterExternalSecret с правилом dir", "apps/legacy/ces.yaml", policyManifest("ClusterExternalSecret", "", "bd/legacy/db", "bd/other"), []string{"bd/other"}},
+	} {
+		got := policyViolations(policy, tc.file, tc.manifest)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: %v, ожидали %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: %v, ожидали %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPathPolicyDefaultDeny(t *testing.T) {
+	policy := loadTestPolicy(t, "default: deny\n"+testPolicy)
+	if got := policyViolations(policy, "apps/other/es.yaml", policyManifest("ExternalSecret", "other", "bd/anything")); len(got) != 1 {
+		t.Errorf("default deny: %v", got)
+	}
+}
+
+func TestLoadPathPolicyErrors(t *testing.T) {
+	for _, policy := range []string{
+		"default: maybe\n",
+		"rules:\n- allow: [bd/]\n",
+		"rules:\n- namespace: \"[\"\n  allow: [bd/]\n",
+	} {
+		file := filepath.Join(t.TempDir(), "policy.yaml")
+		if err := os.WriteFile(file, []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPathPolicy(file); err == nil {
+			t.Errorf("%q: ожидали ошибку", policy)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "sync"
+
+// workerPool ограничивает число одновременно выполняемых проверок
+type workerPool struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &workerPool{sem: make(chan struct{}, size)}
+}
+
+// Go запускает задачу, дожидаясь свободного места в пуле
+func (p *workerPool) Go(task func()) {
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		task()
+	}()
+}
+
+func (p *workerPool) Wait() {
+	p.wg.Wait()
+}
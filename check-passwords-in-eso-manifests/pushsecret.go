@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PushSecret - поля манифеста PushSecret, которые нужны для проверки: какой Secret и куда в Vault отправляется
+type PushSecret struct {
+	File     string `yaml:"-"`
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec struct {
+		SecretStoreRefs []SecretStoreRef `yaml:"secretStoreRefs"`
+		Selector        struct {
+			Secret struct {
+				Name string `yaml:"name"`
+			} `yaml:"secret"`
+		} `yaml:"selector"`
+		Data []PushSecretData `yaml:"data"`
+	} `yaml:"spec"`
+	Line int `yaml:"-"`
+}
+
+func (p *PushSecret) UnmarshalYAML(value *yaml.Node) error {
+	type plain PushSecret
+	if err := value.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	p.Line = value.Line
+	return nil
+}
+
+// PushSecretData - ключ Secret и путь в Vault, куда он записывается. Line - строка элемента data
+type PushSecretData struct {
+	Match struct {
+		SecretKey string `yaml:"secretKey"`
+		RemoteRef struct {
+			RemoteKey string `yaml:"remoteKey"`
+			Property  string `yaml:"property"`
+		} `yaml:"remoteRef"`
+	} `yaml:"match"`
+	Line int `yaml:"-"`
+}
+
+func (d *PushSecretData) UnmarshalYAML(value *yaml.Node) error {
+	type plain PushSecretData
+	if err := value.Decode((*plain)(d)); err != nil {
+		return err
+	}
+	d.Line = value.Line
+	return nil
+}
+
+func decodePushSecrets(src ManifestSource) []PushSecret {
+	var manifests []PushSecret
+	dec := yaml.NewDecoder(bytes.NewReader(src.Content))
+	for {
+		var manifest PushSecret
+		if dec.Decode(&manifest) != nil {
+			break
+		}
+		if manifest.Kind != "PushSecret" {
+			continue
+		}
+		manifest.File = src.File
+		if src.Rendered {
+			manifest.Line = 0
+			for i := range manifest.Spec.Data {
+				manifest.Spec.Data[i].Line = 0
+			}
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests
+}
+
+// repoSecretKeys собирает ключи Secret (data, stringData) и SealedSecret (encryptedData), описанных в репозитории,
+// по namespace и имени. Если namespace не указан - по папке манифеста, как в TargetIndex
+func repoSecretKeys(sources []ManifestSource) map[string]map[string]bool {
+	secrets := map[string]map[string]bool{}
+	for _, src := range sources {
+		if !src.HasKind("kind: Secret", "kind: SealedSecret") {
+			continue
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(src.Content))
+		for {
+			var doc yaml.Node
+			if dec.Decode(&doc) != nil {
+				break
+			}
+			if len(doc.Content) == 0 {
+				continue
+			}
+			root := doc.Content[0]
+			var fields []*yaml.Node
+			switch scalarValue(mappingValue(root, "kind")) {
+			case "Secret":
+				fields = []*yaml.Node{mappingValue(root, "data"), mappingValue(root, "stringData")}
+			case "SealedSecret":
+				fields = []*yaml.Node{mappingValue(mappingValue(root, "spec"), "encryptedData")}
+			default:
+				continue
+			}
+			metadata := mappingValue(root, "metadata")
+			namespace := scalarValue(mappingValue(metadata, "namespace"))
+			if namespace == "" {
+				namespace = "dir:" + filepath.Dir(src.File)
+			}
+			id := namespace + "/" + scalarValue(mappingValue(metadata, "name"))
+			if secrets[id] == nil {
+				secrets[id] = map[string]bool{}
+			}
+			for _, field := range fields {
+				if field == nil || field.Kind != yaml.MappingNode {
+					continue
+				}
+				for i := 0; i+1 < len(field.Content); i += 2 {
+					secrets[id][field.Content[i].Value] = true
+				}
+			}
+		}
+	}
+	return secrets
+}
+
+// checkPushSecrets проверяет PushSecret: Secret-источник и его ключи должны создаваться ExternalSecret или описываться
+// в репозитории, а в режиме --check-capabilities учётная запись хранилища должна иметь право записи в путь назначения
+func checkPushSecrets(sources []ManifestSource, stores *StoreIndex, targets *TargetIndex, pool *workerPool, checkedSource func(ManifestSource) bool, report *Report) {
+	var secrets map[string]map[string]bool
+	for _, src := range sources {
+		if !src.HasKind("kind: PushSecret") || !checkedSource(src) {
+			continue
+		}
+		if secrets == nil {
+			secrets = repoSecretKeys(sources)
+		}
+		for _, manifest := range decodePushSecrets(src) {
+			debugOutput("Найден PushSecret " + manifest.Metadata.Name + ", путь к файлу: " + src.File)
+			checkPushSecretSource(manifest, targets, secrets, report)
+			if checkCapabilities {
+				checkPushSecretDestination(manifest, stores, pool, report)
+			}
+		}
+	}
+}
+
+func checkPushSecretSource(manifest PushSecret, targets *TargetIndex, secrets map[string]map[string]bool, report *Report) {
+	name := manifest.Spec.Selector.Secret.Name
+	if name == "" {
+		// источник - генератор, а не Secret
+		return
+	}
+	add := func(line int, key string, property string, reason FailureReason, details string) {
+		debugOutput("!!! [Fail!] ---> PushSecret " + manifest.Metadata.Name + ": " + string(reason) + " " + name + " " + property + " !!!")
+		report.AddFinding(Finding{
+			File:           manifest.File,
+			Line:           line,
+			Kind:           "PushSecret",
+			ExternalSecret: manifest.Metadata.Name,
+			Key:            key,
+			Property:       property,
+			Reason:         reason,
+			Details:        details,
+		})
+	}
+
+	var keys map[string]bool
+	var producer string
+	target := targets.Find(manifest.Metadata.Namespace, manifest.File, name)
+	if target != nil {
+		if !target.Complete {
+			// набор ключей dataFrom неизвестен
+			return
+		}
+		keys, producer = target.Keys, target.Manifest.Kind+" "+target.Manifest.Metadata.Name+" создаёт ключи: "
+	} else {
+		namespace := manifest.Metadata.Namespace
+		if namespace == "" {
+			namespace = "dir:" + filepath.Dir(manifest.File)
+		}
+		found := false
+		keys, found = secrets[namespace+"/"+name]
+		if !found {
+			add(manifest.Line, "selector.secret", name, ReasonPushSourceMissing, "нет ни ExternalSecret с таким target, ни Secret/SealedSecret")
+			return
+		}
+		producer = "в Secret " + name + " есть ключи: "
+	}
+
+	for _, v := range manifest.Spec.Data {
+		key := v.Match.SecretKey
+		if key == "" || keys[key] {
+			continue
+		}
+		details := producer + listCandidates(sortedKeys(keys))
+		if best, ok := closestMatch(key, sortedKeys(keys)); ok {
+			details = "возможно имелось в виду " + best + "? " + details
+		}
+		add(v.Line, "secretKey "+name, key, ReasonPushKeyMissing, details)
+	}
+}
+
+// checkPushSecretDestination проверяет через sys/capabilities право записи в пути назначения для каждого хранилища
+func checkPushSecretDestination(manifest PushSecret, stores *StoreIndex, pool *workerPool, report *Report) {
+	for _, ref := range manifest.Spec.SecretStoreRefs {
+		if ref.Name == "" {
+			// хранилища по labelSelector не разрешаются
+			continue
+		}
+		store, err := stores.Resolve(manifest.Metadata.Namespace, ref)
+		identity := config.Capabilities.IdentityFor(manifest.Metadata.Namespace, ref)
+		if err != nil || identity == nil {
+			reason, details := ReasonIdentityUnknown, ""
+			if err != nil {
+				reason, details = ReasonStoreNotResolved, err.Error()
+			}
+			report.AddFinding(Finding{
+				File:           manifest.File,
+				Line:           manifest.Line,
+				Kind:           "PushSecret",
+				ExternalSecret: manifest.Metadata.Name,
+				Key:            "secretStoreRefs " + ref.Name,
+				Reason:         reason,
+				Details:        details,
+			})
+			continue
+		}
+		for _, v := range manifest.Spec.Data {
+			v := v
+			if v.Match.RemoteRef.RemoteKey == "" {
+				continue
+			}
+			pool.Go(func() {
+				debugOutput("---> Проверяем право записи PushSecret " + manifest.Metadata.Name + " в " + store.SecretURL(v.Match.RemoteRef.RemoteKey))
+				reason, details := checkStoreCanWrite(identity, store, v.Match.RemoteRef.RemoteKey)
+				report.AddFinding(Finding{
+					File:           manifest.File,
+					Line:           v.Line,
+					Kind:           "PushSecret",
+					ExternalSecret: manifest.Metadata.Name,
+					Key:            v.Match.RemoteRef.RemoteKey,
+					Property:       v.Match.RemoteRef.Property,
+					Reason:         reason,
+					Details:        details,
+				})
+			})
+		}
+	}
+}
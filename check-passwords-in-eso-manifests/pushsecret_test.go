@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPushSecrets(t *testing.T) {
+	vault, kv2, _ := testVault(t)
+	vault.allowed = func(apiPath string) bool { return strings.HasPrefix(apiPath, "bd/data/push/") }
+	previous := config
+	config.Capabilities = CapabilitiesConfig{Stores: []StoreIdentity{{Name: "vault", Accessor: "eso-push"}}}
+	checkCapabilities = true
+	t.Cleanup(func() { config, checkCapabilities = previous, false })
+
+	sources := []ManifestSource{
+		{File: "apps/app/secrets.yaml", Content: []byte(`apiVersion: external-secrets.io/v1beta1
+kind: SecretStore
+metadata:
+  name: vault
+  namespace: app
+spec:
+  provider:
+    vault:
+      server: ` + kv2.Server + `
+      path: bd
+---
+apiVersion: bitnami.com/v1alpha1
+kind: SealedSecret
+metadata:
+  name: sealed
+  namespace: app
+spec:
+  encryptedData:
+    api-key: AgBy8hC...
+`)},
+		{File: "apps/app/push.yaml", Content: []byte(`apiVersion: external-secrets.io/v1alpha1
+kind: PushSecret
+metadata:
+  name: push-sealed
+  namespace: app
+spec:
+  secretStoreRefs:
+  - name: vault
+  selector:
+    secret:
+      name: sealed
+  data:
+  - match:
+      secretKey: api-key
+      remoteRef:
+        remoteKey: push/api
+  - match:
+      secretKey: apikey
+      remoteRef:
+        remoteKey: app/api
+---
+apiVersion: external-secrets.io/v1alpha1
+kind: PushSecret
+metadata:
+  name: push-db
+  namespace: app
+spec:
+  secretStoreRefs:
+  - name: vault
+  selector:
+    secret:
+      name: db
+  data:
+  - match:
+      secretKey: password
+      remoteRef:
+        remoteKey: push/db
+  - match:
+      secretKey: pass
+---
+apiVersion: external-secrets.io/v1alpha1
+kind: PushSecret
+metadata:
+  name: push-missing
+  namespace: app
+spec:
+  selector:
+    secret:
+      name: missing
+`)},
+	}
+	stores := NewStoreIndex()
+	stores.LoadSource(sources[0])
+	targets := NewTargetIndex()
+	var db ExternalSecret
+	db.Kind = "ExternalSecret"
+	db.Metadata.Name, db.Metadata.Namespace = "db", "app"
+	db.Spec.Data = []ExternalSecretData{{SecretKey: "password"}}
+	targets.RegisterStatic(db)
+
+	report := &Report{}
+	pool := newWorkerPool(2)
+	checkPushSecrets(sources, stores, targets, pool, func(ManifestSource) bool { return true }, report)
+	pool.Wait()
+
+	got := map[string]FailureReason{}
+	for _, f := range report.Failures() {
+		if f.Kind != "PushSecret" {
+			t.Errorf("вид объекта: %+v", f)
+		}
+		got[f.ExternalSecret+" "+f.Key+" "+f.Property] = f.Reason
+	}
+	want := map[string]FailureReason{
+		"push-sealed secretKey sealed apikey":  ReasonPushKeyMissing,
+		"push-sealed app/api ":                 ReasonStoreCannotWrite,
+		"push-db secretKey db pass":            ReasonPushKeyMissing,
+		"push-missing selector.secret missing": ReasonPushSourceMissing,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("замечания: %v", got)
+	}
+	for k, reason := range want {
+		if got[k] != reason {
+			t.Errorf("%s: %q, ожидали %q", k, got[k], reason)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+var kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// renderSources собирает манифесты так, как их применит Flux:
+// корневые kustomization собираются kustomize, файлы вне папок с kustomization берутся как есть,
+// а для HelmRelease с локальным чартом (из GitRepository) чарт шаблонизируется с values из HelmRelease
+func renderSources(root string, files []string, report *Report) []ManifestSource {
+	kustomizeDirs := findDirsWithFile(root, kustomizationFileNames...)
+	chartDirs := findDirsWithFile(root, "Chart.yaml")
+
+	var plainFiles []string
+	for _, fileName := range files {
+		if isInsideDir(fileName, kustomizeDirs) {
+			// файлы оверлея (в том числе патчи в подпапках) попадают в манифесты только через kustomize build
+			continue
+		}
+		if isInsideDir(fileName, chartDirs) {
+			// шаблоны чартов без values не являются валидными манифестами
+			continue
+		}
+		plainFiles = append(plainFiles, fileName)
+	}
+	sources := readSources(plainFiles)
+
+	for _, dir := range kustomizeRoots(kustomizeDirs) {
+		debugOutput("Собираем kustomize оверлей: " + dir)
+		content, err := buildKustomization(dir)
+		if err != nil {
+			addRenderFailure(report, dir, "kustomize build", err)
+			continue
+		}
+		sources = append(sources, ManifestSource{File: kustomizationFile(dir), Content: content, Rendered: true})
+	}
+
+	// путь чарта в HelmRelease задаётся от корня GitRepository, а не от LOOKUP_FOLDER
+	chartRoot := repositoryRoot(root)
+	if chartRoot == "" {
+		chartRoot = root
+	}
+	var charts []ManifestSource
+	for _, src := range sources {
+		if !src.HasKind("kind: HelmRelease") {
+			continue
+		}
+		charts = append(charts, renderHelmReleases(chartRoot, src, report)...)
+	}
+	return append(sources, charts...)
+}
+
+func addRenderFailure(report *Report, fileName string, stage string, err error) {
+	debugOutput("!!! [Fail!] ---> " + stage + " " + fileName + ": " + err.Error() + " !!!")
+	report.AddFinding(Finding{
+		File:    fileName,
+		Key:     stage,
+		Reason:  ReasonRenderFailed,
+		Details: err.Error(),
+	})
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+func isInsideDir(fileName string, dirs map[string]string) bool {
+	abs := absPath(fileName)
+	for dir := range dirs {
+		if strings.HasPrefix(abs, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func kustomizationFile(dir string) string {
+	for _, name := range kustomizationFileNames {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return dir
+}
+
+// findDirsWithFile возвращает папки, в которых есть файл с одним из имён: абсолютный путь -> путь относительно root
+func findDirsWithFile(root string, names ...string) map[string]string {
+	dirs := map[string]string{}
+	_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		for _, name := range names {
+			if info.Name() == name {
+				dirs[absPath(filepath.Dir(path))] = filepath.Dir(path)
+			}
+		}
+		return nil
+	})
+	return dirs
+}
+
+// kustomizeRoots отбрасывает папки, которые подключены как resources/components другой kustomization,
+// чтобы базы не проверялись отдельно от оверлеев
+func kustomizeRoots(dirs map[string]string) []string {
+	type Kustomization struct {
+		Resources  []string `yaml:"resources"`
+		Bases      []string `yaml:"bases"`
+		Components []string `yaml:"components"`
+	}
+
+	referenced := map[string]bool{}
+	for dir := range dirs {
+		fl, err := ioutil.ReadFile(kustomizationFile(dir))
+		if err != nil {
+			continue
+		}
+		var kustomization Kustomization
+		if yaml.Unmarshal(fl, &kustomization) != nil {
+			continue
+		}
+		for _, ref := range append(append(kustomization.Resources, kustomization.Bases...), kustomization.Components...) {
+			refDir := filepath.Clean(filepath.Join(dir, ref))
+			if _, found := dirs[refDir]; found {
+				referenced[refDir] = true
+			}
+		}
+	}
+
+	var roots []string
+	for dir, path := range dirs {
+		if !referenced[dir] {
+			roots = append(roots, path)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+func buildKustomization(dir string) ([]byte, error) {
+	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resMap, err := k.Run(filesys.MakeFsOnDisk(), dir)
+	if err != nil {
+		return nil, err
+	}
+	return resMap.AsYaml()
+}
+
+// HelmRelease - поля Flux HelmRelease, нужные для шаблонизации локального чарта
+type HelmRelease struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec struct {
+		ReleaseName     string `yaml:"releaseName"`
+		TargetNamespace string `yaml:"targetNamespace"`
+		Chart           struct {
+			Spec struct {
+				Chart     string `yaml:"chart"`
+				SourceRef struct {
+					Kind string `yaml:"kind"`
+					Name string `yaml:"name"`
+				} `yaml:"sourceRef"`
+			} `yaml:"spec"`
+		} `yaml:"chart"`
+		Values map[string]interface{} `yaml:"values"`
+	} `yaml:"spec"`
+}
+
+// renderHelmReleases шаблонизирует локальные чарты всех HelmRelease из манифеста
+func renderHelmReleases(root string, src ManifestSource, report *Report) []ManifestSource {
+	var sources []ManifestSource
+	dec := yaml.NewDecoder(bytes.NewReader(src.Content))
+	for {
+		var release HelmRelease
+		if dec.Decode(&release) != nil {
+			break
+		}
+		if release.Kind != "HelmRelease" {
+			continue
+		}
+		chartSpec := release.Spec.Chart.Spec
+		if chartSpec.SourceRef.Kind != "GitRepository" && chartSpec.SourceRef.Kind != "Bucket" {
+			debugOutput("---> Пропускаем HelmRelease " + release.Metadata.Name + ": чарт " + chartSpec.Chart + " не из репозитория (" + chartSpec.SourceRef.Kind + ")")
+			continue
+		}
+		debugOutput("Шаблонизируем чарт " + chartSpec.Chart + " из HelmRelease " + release.Metadata.Name)
+		content, err := templateHelmRelease(root, release)
+		if err != nil {
+			addRenderFailure(report, src.File, "helm template "+release.Metadata.Name, err)
+			continue
+		}
+		sources = append(sources, ManifestSource{File: src.File, Content: content, Rendered: true})
+	}
+	return sources
+}
+
+func templateHelmRelease(root string, release HelmRelease) ([]byte, error) {
+	chrt, err := loader.Load(filepath.Join(root, release.Spec.Chart.Spec.Chart))
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := release.Metadata.Namespace
+	releaseName := release.Metadata.Name
+	if release.Spec.TargetNamespace != "" {
+		namespace = release.Spec.TargetNamespace
+		// Flux по умолчанию называет релиз <targetNamespace>-<name>
+		releaseName = release.Spec.TargetNamespace + "-" + release.Metadata.Name
+	}
+	if release.Spec.ReleaseName != "" {
+		releaseName = release.Spec.ReleaseName
+	}
+
+	client := action.NewInstall(&action.Configuration{Log: func(string, ...interface{}) {}})
+	client.DryRun = true
+	client.ClientOnly = true
+	client.Replace = true
+	client.ReleaseName = releaseName
+	client.Namespace = namespace
+
+	values := release.Spec.Values
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	rel, err := client.Run(chrt, values)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(rel.Manifest)), nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTree создаёт файлы с путями относительно root
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// git выполняет команду git в dir от имени тестового пользователя
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v %s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// gitRepo создаёт git репозиторий с одним коммитом из files
+func gitRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTree(t, root, files)
+	git(t, root, "init", "-q")
+	git(t, root, "add", "-A")
+	git(t, root, "commit", "-q", "-m", "base")
+	return root
+}
+
+func TestRenderSourcesSkipsKustomizeSubfolders(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"apps/prod/kustomization.yaml": "resources:\n- es.yaml\npatches:\n- path: patches/es.yaml\n",
+		"apps/prod/es.yaml": `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+`,
+		// частичный ExternalSecret: сам по себе не манифест, только патч
+		"apps/prod/patches/es.yaml": `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  refreshInterval: 1h
+`,
+		"apps/plain/es.yaml": "apiVersion: external-secrets.io/v1beta1\nkind: ExternalSecret\nmetadata:\n  name: plain\n",
+	})
+	files, _ := FilePathWalkDir(root, "yaml")
+
+	report := &Report{}
+	sources := renderSources(root, files, report)
+	if failures := report.Failures(); len(failures) != 0 {
+		t.Fatalf("ошибки рендера: %+v", failures)
+	}
+	var plain, rendered []string
+	for _, src := range sources {
+		rel, _ := filepath.Rel(root, src.File)
+		if src.Rendered {
+			rendered = append(rendered, rel)
+		} else {
+			plain = append(plain, rel)
+		}
+	}
+	if len(plain) != 1 || plain[0] != filepath.Join("apps", "plain", "es.yaml") {
+		t.Errorf("файлы без рендера: %v", plain)
+	}
+	if len(rendered) != 1 || rendered[0] != filepath.Join("apps", "prod", "kustomization.yaml") {
+		t.Errorf("отрендеренные: %v", rendered)
+	}
+	for _, src := range sources {
+		if src.Rendered && !strings.Contains(string(src.Content), "refreshInterval: 1h") {
+			t.Errorf("патч не применён:\n%s", src.Content)
+		}
+	}
+}
+
+func TestRenderHelmReleaseChartFromRepositoryRoot(t *testing.T) {
+	repo := gitRepo(t, map[string]string{
+		"charts/app/Chart.yaml": "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"charts/app/templates/es.yaml": `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  data:
+  - secretKey: password
+    remoteRef:
+      key: {{ .Values.vaultKey }}
+`,
+		"clusters/prod/release.yaml": `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: app
+  namespace: prod
+spec:
+  chart:
+    spec:
+      chart: ./charts/app
+      sourceRef:
+        kind: GitRepository
+        name: flux-system
+  values:
+    vaultKey: prod/app
+`,
+	})
+	// LOOKUP_FOLDER - папка кластера, а чарт лежит в корне репозитория
+	lookup := filepath.Join(repo, "clusters", "prod")
+	files, _ := FilePathWalkDir(lookup, "yaml")
+
+	report := &Report{}
+	sources := renderSources(lookup, files, report)
+	if failures := report.Failures(); len(failures) != 0 {
+		t.Fatalf("ошибки рендера: %+v", failures)
+	}
+	found := false
+	for _, src := range sources {
+		for _, manifest := range decodeExternalSecrets(src) {
+			found = manifest.Metadata.Name == "app" && manifest.Spec.Data[0].RemoteRef.Key == "prod/app"
+		}
+	}
+	if !found {
+		t.Errorf("ExternalSecret из чарта не найден: %+v", sources)
+	}
+}
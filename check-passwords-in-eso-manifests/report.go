@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FailureReason - причина, по которой ссылка на секрет не прошла проверку
+type FailureReason string
+
+const (
+	ReasonForbidden          FailureReason = "нет доступа к пути (403)"
+	ReasonPathNotFound       FailureReason = "путь не найден (404)"
+	ReasonPropertyNotFound   FailureReason = "свойство отсутствует в секрете"
+	ReasonNetworkError       FailureReason = "ошибка сети"
+	ReasonUnexpected         FailureReason = "неожиданный ответ Vault"
+	ReasonStoreNotResolved   FailureReason = "не удалось определить хранилище"
+	ReasonNotAnObject        FailureReason = "свойство не является JSON объектом"
+	ReasonFindNoMatch        FailureReason = "find не нашёл ни одного секрета"
+	ReasonInvalidRegexp      FailureReason = "некорректное регулярное выражение"
+	ReasonTemplateKey        FailureReason = "ключ шаблона не предоставлен data/dataFrom"
+	ReasonRenderFailed       FailureReason = "не удалось отрендерить манифесты"
+	ReasonVersionNotFound    FailureReason = "закреплённая версия секрета не существует"
+	ReasonVersionDeleted     FailureReason = "версия секрета удалена (soft delete)"
+	ReasonVersionDestroyed   FailureReason = "версия секрета уничтожена (destroy)"
+	ReasonLatestDeleted      FailureReason = "последняя версия секрета удалена, свойство есть в более старой версии"
+	ReasonStoreCannotRead    FailureReason = "у учётной записи хранилища ESO нет права read на путь"
+	ReasonStoreCannotWrite   FailureReason = "у учётной записи хранилища ESO нет права create/update на путь"
+	ReasonIdentityUnknown    FailureReason = "не задана учётная запись хранилища для проверки прав"
+	ReasonRefreshInterval    FailureReason = "некорректный refreshInterval"
+	ReasonDuplicateKey       FailureReason = "secretKey повторяется в ExternalSecret"
+	ReasonDuplicateTarget    FailureReason = "целевой Secret создаётся несколькими ExternalSecret"
+	ReasonNoStoreRef         FailureReason = "не указан secretStoreRef"
+	ReasonAPIVersion         FailureReason = "неподдерживаемая apiVersion"
+	ReasonPlaintextSecret    FailureReason = "Secret содержит данные в открытом виде"
+	ReasonKnownToken         FailureReason = "найден токен известного формата"
+	ReasonHighEntropy        FailureReason = "строка с высокой энтропией, похожа на пароль"
+	ReasonKeyNotProduced     FailureReason = "ключ не создаётся ExternalSecret"
+	ReasonKeyUnused          FailureReason = "ключ ExternalSecret не используется нагрузками"
+	ReasonPathNotAllowed     FailureReason = "путь запрещён политикой для namespace"
+	ReasonParityMissingApp   FailureReason = "ExternalSecret есть не во всех окружениях"
+	ReasonParityMissingKey   FailureReason = "ключ есть в другом окружении"
+	ReasonParityVaultMissing FailureReason = "свойства из эталонного окружения нет в Vault окружения"
+	ReasonParityDuplicate    FailureReason = "приложение описано в окружении несколькими ExternalSecret"
+	ReasonPushSourceMissing  FailureReason = "Secret для PushSecret не создаётся манифестами репозитория"
+	ReasonPushKeyMissing     FailureReason = "ключа нет в Secret, который отправляет PushSecret"
+)
+
+// Severity - серьёзность непрошедшей проверки: error валит пайплайн, warning только выводится
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// warningReasons - причины, которые по умолчанию не валят пайплайн
+var warningReasons = map[FailureReason]bool{
+	ReasonLatestDeleted:    true,
+	ReasonIdentityUnknown:  true,
+	ReasonHighEntropy:      true,
+	ReasonKeyUnused:        true,
+	ReasonParityMissingApp: true,
+	ReasonParityDuplicate:  true,
+}
+
+// Finding - результат проверки одной ссылки remoteRef. Пустой Reason означает, что проверка пройдена
+type Finding struct {
+	File string
+	Line int
+	// Kind - вид объекта, к которому относится результат. Пустой - ExternalSecret
+	Kind           string
+	ExternalSecret string
+	Key            string
+	Property       string
+	Reason         FailureReason
+	Severity       Severity
+	Details        string
+}
+
+func (f Finding) Failed() bool {
+	return f.Reason != ""
+}
+
+// Object - вид и имя объекта для отчёта
+func (f Finding) Object() string {
+	kind := f.Kind
+	if kind == "" {
+		kind = "ExternalSecret"
+	}
+	return kind + " " + f.ExternalSecret
+}
+
+func (f Finding) IsError() bool {
+	return f.Failed() && f.Severity != SeverityWarning
+}
+
+// Description - описание ошибки в одну строку: ссылка, причина и подробности
+func (f Finding) Description() string {
+	description := f.Key
+	if f.Property != "" {
+		description += " / " + f.Property
+	}
+	description += ": " + string(f.Reason)
+	if f.Details != "" {
+		description += " (" + f.Details + ")"
+	}
+	return description
+}
+
+// Report копит результаты проверки всех манифестов, чтобы вывести их одним списком в конце.
+// Проверки идут параллельно, поэтому добавление результатов защищено мьютексом
+type Report struct {
+	mu      sync.Mutex
+	Results []Finding
+}
+
+func (r *Report) AddFinding(f Finding) {
+	if f.Failed() && f.Severity == "" {
+		f.Severity = SeverityError
+		if warningReasons[f.Reason] {
+			f.Severity = SeverityWarning
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Results = append(r.Results, f)
+}
+
+// Failures возвращает только непрошедшие проверки (ошибки и предупреждения)
+func (r *Report) Failures() []Finding {
+	var failures []Finding
+	for _, f := range r.Results {
+		if f.Failed() {
+			failures = append(failures, f)
+		}
+	}
+	return failures
+}
+
+// SortedFailures возвращает непрошедшие проверки, упорядоченные по файлу, объекту и строке
+func (r *Report) SortedFailures() []Finding {
+	findings := r.Failures()
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return findings[i].File < findings[j].File
+		}
+		if findings[i].Object() != findings[j].Object() {
+			return findings[i].Object() < findings[j].Object()
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings
+}
+
+func (r *Report) ErrorCount() int {
+	errorCount := 0
+	for _, f := range r.Results {
+		if f.IsError() {
+			errorCount++
+		}
+	}
+	return errorCount
+}
+
+// HasFailures - есть ли ошибки, из-за которых нужно завалить пайплайн
+func (r *Report) HasFailures() bool {
+	for _, f := range r.Results {
+		if f.IsError() {
+			return true
+		}
+	}
+	return false
+}
+
+// Print выводит сводку, сгруппированную по файлу и ExternalSecret
+func (r *Report) Print() {
+	findings := r.SortedFailures()
+	if len(findings) == 0 {
+		log.Printf("Проверено ссылок на секреты: %d, ошибок не найдено\n", len(r.Results))
+		return
+	}
+	errorCount := r.ErrorCount()
+
+	log.Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>><<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<")
+	log.Printf("Проверено ссылок на секреты: %d, с ошибками: %d, с предупреждениями: %d\n", len(r.Results), errorCount, len(findings)-errorCount)
+	var file, externalSecret string
+	for _, f := range findings {
+		if f.File != file {
+			file = f.File
+			externalSecret = ""
+			log.Println("Файл: " + file)
+		}
+		if f.Object() != externalSecret {
+			externalSecret = f.Object()
+			log.Println("  " + strings.Replace(externalSecret, " ", ": ", 1))
+		}
+		tag := "[Fail!]"
+		if !f.IsError() {
+			tag = "[Warn!]"
+		}
+		if f.Line > 0 {
+			log.Printf("    %s строка %d: %s\n", tag, f.Line, f.Description())
+		} else {
+			log.Printf("    %s %s\n", tag, f.Description())
+		}
+	}
+	if errorCount > 0 {
+		log.Println(">>>>         Проверьте корректность секретов! Возможно опечатка. Аварийно завершаем пайплайн.       <<<<<")
+	}
+	log.Println(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>><<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<<")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+)
+
+func testReport() *Report {
+	report := &Report{}
+	report.AddFinding(Finding{File: "apps/es.yaml", Line: 12, ExternalSecret: "db", Key: "app/db", Property: "DB_PASSWORD"})
+	report.AddFinding(Finding{File: "apps/es.yaml", Line: 16, ExternalSecret: "db", Key: "app/db", Property: "DB_USR", Reason: ReasonPropertyNotFound})
+	report.AddFinding(Finding{File: "apps/es.yaml", Line: 0, ExternalSecret: "db", Key: "secretKey", Property: "extra", Reason: ReasonKeyUnused})
+	return report
+}
+
+func TestReportSeverity(t *testing.T) {
+	report := testReport()
+	failures := report.Failures()
+	if len(failures) != 2 {
+		t.Fatalf("Failures() = %+v", failures)
+	}
+	if failures[0].Severity != SeverityError || failures[1].Severity != SeverityWarning {
+		t.Errorf("серьёзность по умолчанию: %q, %q", failures[0].Severity, failures[1].Severity)
+	}
+	if !report.HasFailures() {
+		t.Error("HasFailures() = false при ошибке")
+	}
+
+	warnings := &Report{}
+	warnings.AddFinding(Finding{ExternalSecret: "db", Reason: ReasonKeyUnused})
+	warnings.AddFinding(Finding{ExternalSecret: "db", Reason: ReasonPropertyNotFound, Severity: SeverityWarning})
+	if warnings.HasFailures() {
+		t.Error("предупреждения не должны валить пайплайн")
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().WriteJUnit(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Tests != 3 || suites.Failures != 1 || len(suites.TestSuites) != 1 {
+		t.Fatalf("tests=%d failures=%d suites=%d", suites.Tests, suites.Failures, len(suites.TestSuites))
+	}
+	cases := suites.TestSuites[0].TestCases
+	if cases[1].Failure == nil || cases[1].Failure.Message != string(ReasonPropertyNotFound) {
+		t.Errorf("ошибка: %+v", cases[1])
+	}
+	if cases[2].Failure != nil || cases[2].SystemOut == "" {
+		t.Errorf("предупреждение: %+v", cases[2])
+	}
+	if cases[0].Name != "app/db/DB_PASSWORD" {
+		t.Errorf("имя testcase: %q", cases[0].Name)
+	}
+
+	// у находок без свойства (lint, parity, plaintext) имя testcase не оканчивается на "/"
+	report := &Report{}
+	report.AddFinding(Finding{File: "apps/es.yaml", Line: 3, ExternalSecret: "db", Key: "apiVersion", Reason: ReasonAPIVersion})
+	buf.Reset()
+	if err := report.WriteJUnit(&buf); err != nil {
+		t.Fatal(err)
+	}
+	suites = junitTestSuites{}
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	if name := suites.TestSuites[0].TestCases[0].Name; name != "apiVersion" {
+		t.Errorf("имя testcase без свойства: %q", name)
+	}
+}
+
+func TestWriteCodeQuality(t *testing.T) {
+	var buf bytes.Buffer
+	if err := testReport().WriteCodeQuality(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var issues []codeQualityIssue
+	if err := json.Unmarshal(buf.Bytes(), &issues); err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 2 {
+		t.Fatalf("issues = %+v", issues)
+	}
+	if issues[0].Severity != "critical" || issues[0].Location.Lines.Begin != 16 {
+		t.Errorf("ошибка: %+v", issues[0])
+	}
+	// строка неизвестна - GitLab должен получить начало файла
+	if issues[1].Severity != "minor" || issues[1].Location.Lines.Begin != 1 {
+		t.Errorf("предупреждение: %+v", issues[1])
+	}
+	if issues[0].Fingerprint == issues[1].Fingerprint {
+		t.Error("одинаковые отпечатки у разных замечаний")
+	}
+}
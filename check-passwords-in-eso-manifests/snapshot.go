@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+)
+
+// snapshotBackend - снимок Vault из файла (--snapshot): пути секретов вместе с mount и имена их свойств без значений.
+// Файл в YAML или JSON:
+//
+//	bd/app/db: [DB_PASSWORD, DB_USER]
+//	bd/app/config: [database.host, database.port]
+//
+// Свойство с точкой - путь во вложенный JSON, как property в remoteRef. Адрес сервера Vault и версии не учитываются
+type snapshotBackend struct {
+	secrets map[string][]string
+}
+
+func loadSnapshot(file string) (*snapshotBackend, error) {
+	fl, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secrets := map[string][]string{}
+	if err := yaml.Unmarshal(fl, &secrets); err != nil {
+		return nil, err
+	}
+	snapshot := &snapshotBackend{secrets: map[string][]string{}}
+	for secretPath, properties := range secrets {
+		snapshot.secrets[path.Clean(strings.Trim(secretPath, "/"))] = properties
+	}
+	return snapshot, nil
+}
+
+func (s *snapshotBackend) ReadSecret(store VaultProvider, key string, version string) (gjson.Result, FailureReason, string) {
+	mount, secretPath := store.SplitKey(key)
+	properties, found := s.secrets[path.Clean(mount+"/"+secretPath)]
+	if !found {
+		return gjson.Result{}, ReasonPathNotFound, ""
+	}
+	return snapshotSecretData(properties), "", ""
+}
+
+func (s *snapshotBackend) ListSecrets(store VaultProvider, mount string, folder string) ([]string, FailureReason, string) {
+	prefix := path.Join(mount, folder) + "/"
+	entries := map[string]bool{}
+	for secretPath := range s.secrets {
+		if !strings.HasPrefix(secretPath, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(secretPath, prefix)
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i+1]
+		}
+		entries[name] = true
+	}
+	if len(entries) == 0 {
+		// Vault отвечает 404 на LIST пустой или несуществующей папки
+		return nil, ReasonPathNotFound, ""
+	}
+	return sortedKeys(entries), "", ""
+}
+
+func (s *snapshotBackend) ReadMetadata(store VaultProvider, key string) (gjson.Result, bool) {
+	return gjson.Result{}, false
+}
+
+// snapshotSecretData собирает из имён свойств JSON объект с пустыми значениями, по которому работают проверки property
+func snapshotSecretData(properties []string) gjson.Result {
+	data := map[string]interface{}{}
+	for _, property := range properties {
+		node := data
+		parts := strings.Split(property, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		if _, exists := node[parts[len(parts)-1]]; !exists {
+			node[parts[len(parts)-1]] = ""
+		}
+	}
+	body, _ := json.Marshal(data)
+	return gjson.ParseBytes(body)
+}
+
+// snapshotProperties - имена свойств секрета для снимка. Вложенные JSON объекты раскрываются в пути через точку
+func snapshotProperties(secret gjson.Result, prefix string) []string {
+	var properties []string
+	secret.ForEach(func(key, value gjson.Result) bool {
+		if value.IsObject() {
+			properties = append(properties, snapshotProperties(value, prefix+key.String()+".")...)
+		} else {
+			properties = append(properties, prefix+key.String())
+		}
+		return true
+	})
+	sort.Strings(properties)
+	return properties
+}
+
+// runSnapshot - подкоманда snapshot: обходит папки Vault и сохраняет пути и имена свойств секретов (без значений)
+// в файл для --snapshot. Нужен токен с правами list и read
+func runSnapshot(args []string) {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	output := flags.String("output", "", "файл снимка (по умолчанию stdout)")
+	render := flags.Bool("render", false, "собирать kustomize оверлеи и шаблонизировать локальные Helm чарты из HelmRelease")
+	prefixes := flags.String("prefixes", "", "пути Vault через запятую, например bd/apps/,bd/shared/ (по умолчанию все mount из манифестов)")
+	concurrency := flags.Int("concurrency", 8, "число одновременных запросов к Vault")
+	checkError(flags.Parse(args))
+
+	readEnvironment()
+	revokeToken := setupVault()
+	defer revokeToken()
+
+	report := &Report{}
+	sources, stores := loadSources(*render, report)
+	manifests, pushSecrets := loadReferenceManifests(sources)
+	refs := collectVaultReferences(manifests, pushSecrets, stores)
+
+	var roots []string
+	if *prefixes != "" {
+		roots = strings.Split(*prefixes, ",")
+	}
+	secrets, storeOf, err := walkVaultPrefixes(vaultRoots(roots, refs), refs)
+	if err != nil {
+		revokeToken()
+		log.Fatal(err)
+	}
+
+	properties := make([][]string, len(secrets))
+	read := make([]bool, len(secrets))
+	pool := newWorkerPool(*concurrency)
+	for i, fullPath := range secrets {
+		i, fullPath := i, fullPath
+		pool.Go(func() {
+			secret, reason, _ := readVaultSecret(storeOf[fullPath], fullPath, "")
+			if reason != "" {
+				debugOutput("---> Не удалось прочитать " + fullPath + ": " + string(reason))
+				return
+			}
+			properties[i] = snapshotProperties(secret, "")
+			read[i] = true
+		})
+	}
+	pool.Wait()
+
+	snapshot := map[string][]string{}
+	for i, fullPath := range secrets {
+		if read[i] {
+			snapshot[fullPath] = append([]string{}, properties[i]...)
+		}
+	}
+	body, err := yaml.Marshal(snapshot)
+	checkError(err)
+	if *output == "" {
+		_, err = os.Stdout.Write(body)
+		checkError(err)
+		return
+	}
+	checkError(ioutil.WriteFile(*output, body, 0644))
+}
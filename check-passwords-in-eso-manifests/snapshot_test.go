@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotBackend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot.yaml")
+	content := "bd/app/db: [DB_PASSWORD, DB_USER]\n/bd/app/config/: [database.host, database.port]\nbd/shared/smtp: []\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := loadSnapshot(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := secretBackend
+	secretBackend = snapshot
+	t.Cleanup(func() { secretBackend = previous })
+
+	store := VaultProvider{Server: "snapshot", Path: "bd", Version: "v2"}
+	tests := []struct {
+		key      string
+		property string
+		version  string
+		ok       bool
+		reason   FailureReason
+	}{
+		{key: "app/db", property: "DB_USER", ok: true},
+		{key: "app/db", property: "DB_PASSWORD", version: "3", ok: true},
+		{key: "app/config", property: "database.port", ok: true},
+		{key: "shared/smtp", ok: true},
+		{key: "app/db", property: "DB_HOST", reason: ReasonPropertyNotFound},
+		{key: "app/dbb", property: "DB_USER", reason: ReasonPathNotFound},
+		{key: "app/config", property: "database.user", reason: ReasonPropertyNotFound},
+	}
+	for _, tt := range tests {
+		ok, reason, details := isSecretInVaultExists(store, tt.key, tt.property, tt.version)
+		if ok != tt.ok || reason != tt.reason {
+			t.Errorf("%s/%s: получили %v, %q (%s), ожидали %v, %q", tt.key, tt.property, ok, reason, details, tt.ok, tt.reason)
+		}
+	}
+
+	entries, reason, _ := listVaultSecrets(store, "bd", "app")
+	if reason != "" || !reflect.DeepEqual(entries, []string{"config", "db"}) {
+		t.Errorf("LIST bd/app: %v, %q", entries, reason)
+	}
+	secrets, reason, _ := listVaultSecretsRecursive(store, "bd", "")
+	if reason != "" || !reflect.DeepEqual(secrets, []string{"app/config", "app/db", "shared/smtp"}) {
+		t.Errorf("рекурсивный LIST bd: %v, %q", secrets, reason)
+	}
+	if _, reason, _ := listVaultSecrets(store, "bd", "missing"); reason != ReasonPathNotFound {
+		t.Errorf("LIST несуществующей папки: %q", reason)
+	}
+}
+
+func TestSnapshotProperties(t *testing.T) {
+	_, kv2, _ := testVault(t)
+	secret, reason, _ := readVaultSecret(kv2, "app/config", "")
+	if reason != "" {
+		t.Fatal(reason)
+	}
+	if got := snapshotProperties(secret, ""); !reflect.DeepEqual(got, []string{"database.host"}) {
+		t.Errorf("snapshotProperties = %v", got)
+	}
+	// снимок, записанный по живому Vault, должен давать тот же результат проверки свойства
+	if !snapshotSecretData(snapshotProperties(secret, "")).Get("database.host").Exists() {
+		t.Error("вложенное свойство потерялось при записи в снимок")
+	}
+}
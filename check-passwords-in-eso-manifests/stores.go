@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// VaultProvider - блок spec.provider.vault из SecretStore/ClusterSecretStore
+type VaultProvider struct {
+	Server  string `yaml:"server"`
+	Path    string `yaml:"path"`
+	Version string `yaml:"version"`
+}
+
+// SecretStoreRef - ссылка ExternalSecret на хранилище (spec.secretStoreRef)
+type SecretStoreRef struct {
+	Name string `yaml:"name"`
+	Kind string `yaml:"kind"`
+}
+
+// StoreIndex хранит найденные в репозитории SecretStore (по namespace/name) и ClusterSecretStore (по name)
+type StoreIndex struct {
+	namespaced map[string]VaultProvider
+	cluster    map[string]VaultProvider
+}
+
+func NewStoreIndex() *StoreIndex {
+	return &StoreIndex{
+		namespaced: map[string]VaultProvider{},
+		cluster:    map[string]VaultProvider{},
+	}
+}
+
+// LoadSource разбирает все документы манифеста и запоминает SecretStore/ClusterSecretStore с провайдером vault
+func (s *StoreIndex) LoadSource(src ManifestSource) {
+	type Manifest struct {
+		Kind     string `yaml:"kind"`
+		Metadata struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"metadata"`
+		Spec struct {
+			Provider struct {
+				Vault *VaultProvider `yaml:"vault"`
+			} `yaml:"provider"`
+		} `yaml:"spec"`
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(src.Content))
+
+	for {
+		var manifest Manifest
+		if dec.Decode(&manifest) != nil {
+			break
+		}
+		if manifest.Spec.Provider.Vault == nil {
+			continue
+		}
+		switch manifest.Kind {
+		case "SecretStore":
+			s.namespaced[manifest.Metadata.Namespace+"/"+manifest.Metadata.Name] = *manifest.Spec.Provider.Vault
+		case "ClusterSecretStore":
+			s.cluster[manifest.Metadata.Name] = *manifest.Spec.Provider.Vault
+		default:
+			continue
+		}
+		debugOutput("---> Хранилище " + manifest.Kind + " " + manifest.Metadata.Name + ": " + manifest.Spec.Provider.Vault.Server + ", mount " + manifest.Spec.Provider.Vault.Path + ", KV " + manifest.Spec.Provider.Vault.Version)
+	}
+}
+
+// Resolve находит хранилище, на которое ссылается ExternalSecret из namespace.
+// Если хранилище в репозитории не описано - возвращается хранилище по умолчанию (VAULT_ADDR, VAULT_MOUNT, VAULT_KV_VERSION)
+func (s *StoreIndex) Resolve(namespace string, ref SecretStoreRef) (VaultProvider, error) {
+	var store VaultProvider
+	var found bool
+	if ref.Kind == "ClusterSecretStore" {
+		store, found = s.cluster[ref.Name]
+	} else {
+		store, found = s.namespaced[namespace+"/"+ref.Name]
+		if !found && namespace == "" {
+			// namespace у ExternalSecret может проставляться kustomize - ищем SecretStore по имени, если он один
+			store, found = s.findNamespacedByName(ref.Name)
+		}
+	}
+	if !found {
+		debugOutput("---> Хранилище " + ref.Kind + " " + ref.Name + " не найдено в манифестах, используем хранилище по умолчанию")
+		store = defaultStore
+	}
+	if store.Server == "" {
+		store.Server = vaultAddr
+	}
+	if store.Server == "" {
+		return store, errors.New("не удалось определить адрес Vault для хранилища " + ref.Name + ": в манифесте нет spec.provider.vault.server и не задана переменная VAULT_ADDR")
+	}
+	if store.Version == "" {
+		// ESO по умолчанию использует KV v2
+		store.Version = "v2"
+	}
+	return store, nil
+}
+
+func (s *StoreIndex) findNamespacedByName(name string) (VaultProvider, bool) {
+	var store VaultProvider
+	count := 0
+	for key, v := range s.namespaced {
+		if strings.HasSuffix(key, "/"+name) {
+			store = v
+			count++
+		}
+	}
+	return store, count == 1
+}
+
+// SplitKey делит remoteRef.key на mount и путь секрета внутри mount так же, как это делает ESO:
+// если в хранилище не задан path - первым сегментом ключа считается mount
+func (p VaultProvider) SplitKey(key string) (string, string) {
+	key = strings.Trim(key, "/")
+	mount := strings.Trim(p.Path, "/")
+	if mount == "" {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) == 1 {
+			return parts[0], ""
+		}
+		return parts[0], parts[1]
+	}
+	return mount, strings.TrimPrefix(key, mount+"/")
+}
+
+// SecretURL возвращает URL для чтения секрета с учётом версии KV
+func (p VaultProvider) SecretURL(key string) string {
+	return strings.TrimRight(p.Server, "/") + "/v1/" + p.SecretPath(key)
+}
+
+// SecretPath возвращает путь чтения секрета в API Vault (без /v1/) - в таком виде он указывается в политиках
+func (p VaultProvider) SecretPath(key string) string {
+	mount, secretPath := p.SplitKey(key)
+	if p.Version == "v1" {
+		return mount + "/" + secretPath
+	}
+	return mount + "/data/" + secretPath
+}
+
+// DataPath возвращает gjson путь к данным секрета в ответе Vault
+func (p VaultProvider) DataPath() string {
+	if p.Version == "v1" {
+		return "data"
+	}
+	return "data.data"
+}
+
+// ListURL возвращает URL для получения списка секретов в папке (метод LIST) с учётом версии KV
+func (p VaultProvider) ListURL(mount string, folder string) string {
+	folder = strings.Trim(folder, "/")
+	if folder != "" {
+		folder += "/"
+	}
+	if p.Version == "v1" {
+		return strings.TrimRight(p.Server, "/") + "/v1/" + mount + "/" + folder
+	}
+	return strings.TrimRight(p.Server, "/") + "/v1/" + mount + "/metadata/" + folder
+}
+
+// MetadataURL возвращает URL метаданных секрета (только KV v2)
+func (p VaultProvider) MetadataURL(key string) string {
+	mount, secretPath := p.SplitKey(key)
+	return strings.TrimRight(p.Server, "/") + "/v1/" + mount + "/metadata/" + secretPath
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Сколько существующих ключей/путей перечислять в подсказке
+const maxSuggestionCandidates = 10
+
+// levenshtein - редакционное расстояние между строками
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// closestMatch возвращает наиболее похожую строку, если она достаточно близка, чтобы быть опечаткой
+func closestMatch(target string, candidates []string) (string, bool) {
+	best := ""
+	bestDistance := -1
+	for _, c := range candidates {
+		d := levenshtein(strings.ToLower(target), strings.ToLower(c))
+		if bestDistance == -1 || d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	threshold := len(target) / 3
+	if threshold < 2 {
+		threshold = 2
+	}
+	return best, bestDistance >= 0 && bestDistance <= threshold
+}
+
+func listCandidates(candidates []string) string {
+	sorted := append([]string(nil), candidates...)
+	sort.Strings(sorted)
+	if len(sorted) > maxSuggestionCandidates {
+		return strings.Join(sorted[:maxSuggestionCandidates], ", ") + ", ..."
+	}
+	return strings.Join(sorted, ", ")
+}
+
+// suggestProperty подсказывает похожее свойство среди ключей уже прочитанного секрета
+func suggestProperty(secret gjson.Result, property string) string {
+	var keys []string
+	secret.ForEach(func(key, value gjson.Result) bool {
+		keys = append(keys, key.String())
+		return true
+	})
+	if len(keys) == 0 {
+		return "секрет пустой"
+	}
+	suggestion := ""
+	if best, ok := closestMatch(property, keys); ok {
+		suggestion = property + " не найден, возможно имелось в виду " + best + "? "
+	}
+	return suggestion + "Есть ключи: " + listCandidates(keys)
+}
+
+// suggestPath поднимается вверх по пути секрета, которого нет в Vault, и через LIST ищет похожие соседние пути.
+// Если права на list нет - подсказки не будет
+func suggestPath(store VaultProvider, key string) string {
+	mount, secretPath := store.SplitKey(key)
+	parts := strings.Split(secretPath, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		folder := strings.Join(parts[:i], "/")
+		entries, reason, _ := listVaultSecrets(store, mount, folder)
+		if reason == ReasonForbidden {
+			return ""
+		}
+		if reason != "" || len(entries) == 0 {
+			continue
+		}
+
+		prefix := folder
+		if prefix != "" {
+			prefix += "/"
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, strings.TrimSuffix(e, "/"))
+		}
+		suggestion := ""
+		if best, ok := closestMatch(parts[i], names); ok {
+			suggestion = "возможно имелось в виду " + prefix + best + strings.Join(append([]string{""}, parts[i+1:]...), "/") + "? "
+		}
+		return suggestion + "В " + mount + "/" + prefix + " есть: " + listCandidates(names)
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestClosestMatch(t *testing.T) {
+	candidates := []string{"DB_PASSWORD", "DB_USER", "REDIS_URL"}
+	tests := []struct {
+		target string
+		best   string
+		ok     bool
+	}{
+		{target: "DB_PASWORD", best: "DB_PASSWORD", ok: true},
+		{target: "db_user", best: "DB_USER", ok: true},
+		{target: "REDIS", best: "", ok: false},
+		{target: "SMTP_HOST", ok: false},
+	}
+	for _, tt := range tests {
+		best, ok := closestMatch(tt.target, candidates)
+		if ok != tt.ok || ok && best != tt.best {
+			t.Errorf("closestMatch(%q) = %q, %v", tt.target, best, ok)
+		}
+	}
+	if _, ok := closestMatch("DB_USER", nil); ok {
+		t.Error("подсказка без кандидатов")
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"app/db", "app/dbb", 1},
+		{"kitten", "sitting", 3},
+	} {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, ожидали %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/time/rate"
+)
+
+// vaultClient выполняет запросы к Vault с таймаутом, повторами и ограничением частоты.
+// Ответы GET/LIST кэшируются на время запуска: один путь читается из Vault только один раз
+type vaultClient struct {
+	http      *http.Client
+	retries   int
+	limiter   *rate.Limiter
+	namespace string
+
+	mu    sync.Mutex
+	cache map[string]*vaultCacheEntry
+}
+
+type vaultCacheEntry struct {
+	once   sync.Once
+	status int
+	body   string
+	err    error
+}
+
+var vaultAPI = newVaultClient(10*time.Second, 3, 0)
+
+// newVaultClient создаёт клиента. rateLimit - запросов в секунду, 0 - без ограничения
+func newVaultClient(timeout time.Duration, retries int, rateLimit float64) *vaultClient {
+	limiter := rate.NewLimiter(rate.Inf, 1)
+	if rateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(rateLimit), 1)
+	}
+	return &vaultClient{
+		http:    &http.Client{Timeout: timeout},
+		retries: retries,
+		limiter: limiter,
+		cache:   map[string]*vaultCacheEntry{},
+	}
+}
+
+// vaultClientFromEnv читает настройки клиента из VAULT_TIMEOUT, VAULT_RETRIES, VAULT_RATE_LIMIT,
+// VAULT_NAMESPACE и VAULT_CACERT (файл с дополнительными корневыми сертификатами)
+func vaultClientFromEnv() *vaultClient {
+	timeout, err := time.ParseDuration(getVariableOrDefault("VAULT_TIMEOUT", "10s"))
+	if err != nil {
+		log.Fatal("Некорректное значение VAULT_TIMEOUT: " + err.Error())
+	}
+	retries, err := strconv.Atoi(getVariableOrDefault("VAULT_RETRIES", "3"))
+	if err != nil {
+		log.Fatal("Некорректное значение VAULT_RETRIES: " + err.Error())
+	}
+	rateLimit, err := strconv.ParseFloat(getVariableOrDefault("VAULT_RATE_LIMIT", "0"), 64)
+	if err != nil {
+		log.Fatal("Некорректное значение VAULT_RATE_LIMIT: " + err.Error())
+	}
+	client := newVaultClient(timeout, retries, rateLimit)
+	client.namespace = getVariable("VAULT_NAMESPACE", false)
+
+	if caCert := getVariable("VAULT_CACERT", false); caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			log.Fatal("Не удалось прочитать VAULT_CACERT: " + err.Error())
+		}
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			certPool = x509.NewCertPool()
+		}
+		if !certPool.AppendCertsFromPEM(pem) {
+			log.Fatal("В файле VAULT_CACERT не найдено ни одного сертификата")
+		}
+		client.http.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: certPool},
+		}
+	}
+	return client
+}
+
+// vaultRequest выполняет запрос к Vault и возвращает код ответа и тело
+func vaultRequest(method string, url string) (int, string, error) {
+	return vaultAPI.Request(method, url)
+}
+
+func (c *vaultClient) Request(method string, url string) (int, string, error) {
+	if method != "GET" && method != "LIST" {
+		return c.requestWithRetry(method, url, nil)
+	}
+
+	c.mu.Lock()
+	entry, found := c.cache[method+" "+url]
+	if !found {
+		entry = &vaultCacheEntry{}
+		c.cache[method+" "+url] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.status, entry.body, entry.err = c.requestWithRetry(method, url, nil)
+	})
+	return entry.status, entry.body, entry.err
+}
+
+// Write отправляет POST с JSON телом (логин, sys/capabilities). Ответы не кэшируются
+func (c *vaultClient) Write(url string, payload interface{}) (int, string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, "", err
+	}
+	return c.requestWithRetry("POST", url, body)
+}
+
+// requestWithRetry повторяет запрос при сетевой ошибке, 429 и 5xx с экспоненциальной задержкой
+func (c *vaultClient) requestWithRetry(method string, url string, payload []byte) (int, string, error) {
+	var status int
+	var body string
+	var err error
+	delay := 500 * time.Millisecond
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			debugOutput("---> Повторяем запрос " + method + " " + url + " (попытка " + strconv.Itoa(attempt+1) + ")")
+			time.Sleep(delay)
+			delay *= 2
+		}
+		status, body, err = c.do(method, url, payload)
+		if err == nil && status != http.StatusTooManyRequests && status < 500 {
+			break
+		}
+	}
+	return status, body, err
+}
+
+func (c *vaultClient) do(method string, url string, payload []byte) (int, string, error) {
+	if err := c.limiter.Wait(context.Background()); err != nil {
+		return 0, "", err
+	}
+
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return 0, "", err
+	}
+	if vaultToken != "" {
+		req.Header.Add("X-Vault-Token", vaultToken)
+	}
+	if c.namespace != "" {
+		req.Header.Add("X-Vault-Namespace", c.namespace)
+	}
+	if payload != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// vaultFailure переводит ответ Vault в причину ошибки. Пустая причина - ответ 200/204
+func vaultFailure(status int, body string, err error) (FailureReason, string) {
+	if err != nil {
+		return ReasonNetworkError, err.Error()
+	}
+	switch status {
+	case http.StatusOK, http.StatusNoContent:
+		return "", ""
+	case http.StatusForbidden:
+		return ReasonForbidden, ""
+	case http.StatusNotFound:
+		return ReasonPathNotFound, ""
+	default:
+		return ReasonUnexpected, "HTTP " + strconv.Itoa(status) + " " + gjson.Get(body, "errors").String()
+	}
+}
+
+// readVaultSecret читает секрет и возвращает его данные (key/value) независимо от версии KV.
+// version - конкретная версия секрета KV v2, пустая строка - последняя версия
+func readVaultSecret(store VaultProvider, key string, version string) (gjson.Result, FailureReason, string) {
+	return secretBackend.ReadSecret(store, key, version)
+}
+
+// listVaultSecrets возвращает содержимое папки в mount. Вложенные папки оканчиваются на "/"
+func listVaultSecrets(store VaultProvider, mount string, folder string) ([]string, FailureReason, string) {
+	return secretBackend.ListSecrets(store, mount, folder)
+}
+
+// listVaultSecretsRecursive обходит папку и все вложенные папки, возвращает пути секретов относительно mount
+func listVaultSecretsRecursive(store VaultProvider, mount string, folder string) ([]string, FailureReason, string) {
+	keys, reason, details := listVaultSecrets(store, mount, folder)
+	if reason != "" {
+		return nil, reason, details
+	}
+	prefix := strings.Trim(folder, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	var secrets []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			nested, reason, details := listVaultSecretsRecursive(store, mount, prefix+k)
+			if reason != "" {
+				return nil, reason, details
+			}
+			secrets = append(secrets, nested...)
+			continue
+		}
+		secrets = append(secrets, prefix+k)
+	}
+	return secrets, "", ""
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVaultClientCache(t *testing.T) {
+	vault, kv2, _ := testVault(t)
+
+	var wg sync.WaitGroup
+	for _, property := range []string{"DB_PASSWORD", "DB_USER", "DB_PASSWORD", "DB_USER"} {
+		wg.Add(1)
+		go func(property string) {
+			defer wg.Done()
+			if ok, reason, _ := isSecretInVaultExists(kv2, "app/db", property, ""); !ok {
+				t.Errorf("%s: %s", property, reason)
+			}
+		}(property)
+	}
+	wg.Wait()
+	if n := vault.count("GET", "bd/data/app/db"); n != 1 {
+		t.Errorf("путь прочитан %d раз, ожидали один", n)
+	}
+}
+
+func TestVaultClientRetry(t *testing.T) {
+	vault, kv2, _ := testVault(t)
+	vaultAPI = newVaultClient(time.Second, 2, 0)
+
+	vault.failures["bd/data/app/db"] = []int{503}
+	if ok, reason, details := isSecretInVaultExists(kv2, "app/db", "DB_PASSWORD", ""); !ok {
+		t.Errorf("после 503 ожидали успешный повтор: %s %s", reason, details)
+	}
+	if n := vault.count("GET", "bd/data/app/db"); n != 2 {
+		t.Errorf("запросов %d, ожидали 2", n)
+	}
+
+	vault.failures["bd/data/app/config"] = []int{429, 500, 502}
+	if _, reason, _ := isSecretInVaultExists(kv2, "app/config", "database.host", ""); reason != ReasonUnexpected {
+		t.Errorf("после исчерпания повторов: %q", reason)
+	}
+	if n := vault.count("GET", "bd/data/app/config"); n != 3 {
+		t.Errorf("запросов %d, ожидали 3 (VAULT_RETRIES=2)", n)
+	}
+
+	vault.failures["kv1/team/api"] = []int{403}
+	kv1 := VaultProvider{Server: kv2.Server, Path: "kv1", Version: "v1"}
+	if _, reason, _ := isSecretInVaultExists(kv1, "team/api", "TOKEN", ""); reason != ReasonForbidden {
+		t.Errorf("403: %q", reason)
+	}
+	if n := vault.count("GET", "kv1/team/api"); n != 1 {
+		t.Errorf("403 не должен повторяться, запросов %d", n)
+	}
+}
+
+func TestVaultClientRateLimit(t *testing.T) {
+	_, kv2, _ := testVault(t)
+	vaultAPI = newVaultClient(time.Second, 0, 20)
+
+	start := time.Now()
+	for _, key := range []string{"app/db", "app/config", "app/rotated", "app/missing"} {
+		isSecretInVaultExists(kv2, key, "", "")
+	}
+	// первый запрос проходит сразу, остальные не чаще 20 в секунду
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("запросы выполнены за %s, ограничение частоты не работает", elapsed)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// readVaultMetadata читает метаданные секрета KV v2 (версии, время удаления).
+// Если метаданные недоступны (KV v1, нет прав, нет секрета) - второе значение false
+func readVaultMetadata(store VaultProvider, key string) (gjson.Result, bool) {
+	return secretBackend.ReadMetadata(store, key)
+}
+
+// versionState возвращает причину, если версия удалена или уничтожена
+func versionState(version gjson.Result) FailureReason {
+	if version.Get("destroyed").Bool() {
+		return ReasonVersionDestroyed
+	}
+	if version.Get("deletion_time").String() != "" {
+		return ReasonVersionDeleted
+	}
+	return ""
+}
+
+func existingVersions(metadata gjson.Result) string {
+	var versions []int
+	metadata.Get("versions").ForEach(func(key, value gjson.Result) bool {
+		if v, err := strconv.Atoi(key.String()); err == nil {
+			versions = append(versions, v)
+		}
+		return true
+	})
+	sort.Ints(versions)
+	var names []string
+	for _, v := range versions {
+		names = append(names, strconv.Itoa(v))
+	}
+	return "есть версии: " + strings.Join(names, ", ")
+}
+
+// checkPinnedVersion проверяет, что закреплённая в remoteRef.version версия существует и не удалена
+func checkPinnedVersion(store VaultProvider, key string, version string) (FailureReason, string) {
+	metadata, ok := readVaultMetadata(store, key)
+	if !ok {
+		return "", ""
+	}
+	v := metadata.Get("versions." + version)
+	if !v.Exists() {
+		return ReasonVersionNotFound, "версия " + version + ", " + existingVersions(metadata)
+	}
+	if reason := versionState(v); reason != "" {
+		return reason, "версия " + version + ", текущая версия " + metadata.Get("current_version").String()
+	}
+	return "", ""
+}
+
+// checkDeletedLatestVersion разбирает случай, когда чтение последней версии вернуло 404 из-за того,
+// что она удалена или уничтожена. Если свойство есть в одной из предыдущих живых версий - это предупреждение
+func checkDeletedLatestVersion(store VaultProvider, key string, property string) (FailureReason, string) {
+	metadata, ok := readVaultMetadata(store, key)
+	if !ok {
+		return "", ""
+	}
+	current := int(metadata.Get("current_version").Int())
+	latestState := versionState(metadata.Get("versions." + strconv.Itoa(current)))
+	if latestState == "" {
+		return "", ""
+	}
+
+	for v := current - 1; v > 0; v-- {
+		if versionState(metadata.Get("versions."+strconv.Itoa(v))) != "" {
+			continue
+		}
+		secret, reason, _ := readVaultSecret(store, key, strconv.Itoa(v))
+		if reason != "" {
+			continue
+		}
+		if property == "" || secret.Get(property).Exists() {
+			return ReasonLatestDeleted, "версия " + strconv.Itoa(current) + ": " + string(latestState) +
+				", свойство есть в версии " + strconv.Itoa(v) + " - восстановите версию (vault kv undelete) или закрепите remoteRef.version"
+		}
+	}
+	return latestState, "последняя версия " + strconv.Itoa(current) + ", в предыдущих версиях свойства нет"
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SecretTarget - Secret, который создаёт ExternalSecret, и ключи, которые в нём окажутся.
+// Complete false - набор ключей известен не полностью (dataFrom не проверялся или не прочитался)
+type SecretTarget struct {
+	Manifest ExternalSecret
+	Keys     map[string]bool
+	Complete bool
+}
+
+// TargetIndex - целевые Secret всех ExternalSecret по namespace и имени. Заполняется из параллельных проверок dataFrom
+type TargetIndex struct {
+	mu      sync.Mutex
+	targets map[string]*SecretTarget
+}
+
+func NewTargetIndex() *TargetIndex {
+	return &TargetIndex{targets: map[string]*SecretTarget{}}
+}
+
+// Register запоминает ключи целевого Secret с учётом target.template: при mergePolicy Replace
+// в Secret попадают только ключи шаблона
+func (t *TargetIndex) Register(manifest ExternalSecret, providedKeys map[string]bool, complete bool) {
+	keys := providedKeys
+	if template := manifest.Spec.Target.Template; template != nil && len(template.Data) > 0 {
+		keys = map[string]bool{}
+		if template.MergePolicy == "Merge" {
+			for k := range providedKeys {
+				keys[k] = true
+			}
+		} else {
+			complete = true
+		}
+		for k := range template.Data {
+			keys[k] = true
+		}
+	}
+
+	target := &SecretTarget{Manifest: manifest, Keys: keys, Complete: complete}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.targets[targetIdentity(manifest)] = target
+	// нагрузку без namespace (его проставит kustomize или Flux) сопоставляем с ExternalSecret из той же папки
+	t.targets[folderIdentity(manifest.File, targetName(manifest))] = target
+}
+
+// RegisterStatic запоминает ключи из spec.data, когда dataFrom не проверяется
+func (t *TargetIndex) RegisterStatic(manifest ExternalSecret) {
+	keys := map[string]bool{}
+	for _, v := range manifest.Spec.Data {
+		keys[v.SecretKey] = true
+	}
+	t.Register(manifest, keys, len(manifest.Spec.DataFrom) == 0)
+}
+
+// Find ищет целевой Secret нагрузки из file: по namespace, а если у нагрузки или ExternalSecret он не указан - по папке
+func (t *TargetIndex) Find(namespace string, file string, secretName string) *SecretTarget {
+	if namespace == "" {
+		return t.targets[folderIdentity(file, secretName)]
+	}
+	if target, found := t.targets[namespace+"/"+secretName]; found {
+		return target
+	}
+	if target := t.targets[folderIdentity(file, secretName)]; target != nil && target.Manifest.Metadata.Namespace == "" {
+		return target
+	}
+	return nil
+}
+
+func folderIdentity(file string, secretName string) string {
+	return "dir:" + filepath.Dir(file) + "/" + secretName
+}
+
+// secretUsage - ссылка нагрузки на Secret. Key пустой - используется весь Secret (envFrom, том без items)
+type secretUsage struct {
+	Secret   string
+	Key      string
+	Optional bool
+	Field    string
+	Line     int
+}
+
+// Виды нагрузок и путь к шаблону пода в них
+var workloadPodSpecPaths = map[string][]string{
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// checkWorkloadSecretRefs сверяет secretKeyRef, envFrom.secretRef и тома secret в нагрузках с ключами,
+// которые создают ExternalSecret. Secret, не созданные ExternalSecret, не проверяются.
+// checkedSource и checkedManifest - нужно ли сообщать о нагрузке или ExternalSecret (в режиме --since только об изменённых)
+func checkWorkloadSecretRefs(sources []ManifestSource, targets *TargetIndex, checkedSource func(ManifestSource) bool, checkedManifest func(ExternalSecret) bool, report *Report) {
+	// ключи, которые используются хотя бы одной нагрузкой. nil - Secret используется целиком
+	used := map[*SecretTarget]map[string]bool{}
+
+	for _, src := range sources {
+		if !src.HasKind(workloadKinds()...) {
+			continue
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(src.Content))
+		for {
+			var doc yaml.Node
+			if dec.Decode(&doc) != nil {
+				break
+			}
+			if len(doc.Content) == 0 {
+				continue
+			}
+			root := doc.Content[0]
+			kind := scalarValue(mappingValue(root, "kind"))
+			path, found := workloadPodSpecPaths[kind]
+			if !found {
+				continue
+			}
+			metadata := mappingValue(root, "metadata")
+			name := scalarValue(mappingValue(metadata, "name"))
+			namespace := scalarValue(mappingValue(metadata, "namespace"))
+			podSpec := root
+			for _, key := range path {
+				podSpec = mappingValue(podSpec, key)
+			}
+
+			for _, usage := range podSecretUsages(podSpec) {
+				target := targets.Find(namespace, src.File, usage.Secret)
+				if target == nil {
+					continue
+				}
+				if keys, found := used[target]; usage.Key == "" {
+					used[target] = nil
+				} else if !found {
+					used[target] = map[string]bool{usage.Key: true}
+				} else if keys != nil {
+					keys[usage.Key] = true
+				}
+
+				if usage.Key == "" || target.Keys[usage.Key] || !target.Complete {
+					continue
+				}
+				if !checkedSource(src) && !checkedManifest(target.Manifest) {
+					continue
+				}
+				line := usage.Line
+				if src.Rendered {
+					line = 0
+				}
+				details := "ExternalSecret " + target.Manifest.Metadata.Name + " создаёт ключи: " + listCandidates(sortedKeys(target.Keys))
+				if best, ok := closestMatch(usage.Key, sortedKeys(target.Keys)); ok {
+					details = "возможно имелось в виду " + best + "? " + details
+				}
+				severity := SeverityError
+				if usage.Optional {
+					severity = SeverityWarning
+				}
+				debugOutput("!!! [Fail!] ---> " + kind + " " + name + ": ключа " + usage.Key + " нет в Secret " + usage.Secret + " !!!")
+				report.AddFinding(Finding{
+					File:           src.File,
+					Line:           line,
+					Kind:           kind,
+					ExternalSecret: name,
+					Key:            usage.Field + " " + usage.Secret,
+					Property:       usage.Key,
+					Reason:         ReasonKeyNotProduced,
+					Severity:       severity,
+					Details:        details,
+				})
+			}
+		}
+	}
+
+	reportUnusedKeys(used, checkedManifest, report)
+}
+
+// reportUnusedKeys предупреждает о ключах ExternalSecret, которые не использует ни одна из ссылающихся на Secret нагрузок
+func reportUnusedKeys(used map[*SecretTarget]map[string]bool, checkedManifest func(ExternalSecret) bool, report *Report) {
+	for target, keys := range used {
+		if keys == nil || !checkedManifest(target.Manifest) {
+			continue
+		}
+		lines := map[string]int{}
+		for _, v := range target.Manifest.Spec.Data {
+			lines[v.SecretKey] = v.RemoteRef.Line
+		}
+		for _, key := range sortedKeys(target.Keys) {
+			if keys[key] {
+				continue
+			}
+			report.AddFinding(Finding{
+				File:           target.Manifest.File,
+				Line:           lines[key],
+				Kind:           target.Manifest.ReportKind(),
+				ExternalSecret: target.Manifest.Metadata.Name,
+				Key:            "secretKey",
+				Property:       key,
+				Reason:         ReasonKeyUnused,
+			})
+		}
+	}
+}
+
+// podSecretUsages собирает ссылки на Secret из контейнеров, init контейнеров и томов пода
+func podSecretUsages(podSpec *yaml.Node) []secretUsage {
+	var usages []secretUsage
+	for _, field := range []string{"containers", "initContainers"} {
+		containers := mappingValue(podSpec, field)
+		if containers == nil {
+			continue
+		}
+		for _, container := range containers.Content {
+			if env := mappingValue(container, "env"); env != nil {
+				for _, item := range env.Content {
+					ref := mappingValue(mappingValue(item, "valueFrom"), "secretKeyRef")
+					if ref == nil {
+						continue
+					}
+					usages = append(usages, secretUsage{
+						Secret:   scalarValue(mappingValue(ref, "name")),
+						Key:      scalarValue(mappingValue(ref, "key")),
+						Optional: scalarValue(mappingValue(ref, "optional")) == "true",
+						Field:    "secretKeyRef",
+						Line:     ref.Line,
+					})
+				}
+			}
+			if envFrom := mappingValue(container, "envFrom"); envFrom != nil {
+				for _, item := range envFrom.Content {
+					if ref := mappingValue(item, "secretRef"); ref != nil {
+						usages = append(usages, secretUsage{Secret: scalarValue(mappingValue(ref, "name")), Field: "envFrom", Line: ref.Line})
+					}
+				}
+			}
+		}
+	}
+
+	if volumes := mappingValue(podSpec, "volumes"); volumes != nil {
+		for _, volume := range volumes.Content {
+			secret := mappingValue(volume, "secret")
+			if secret == nil {
+				continue
+			}
+			secretName := scalarValue(mappingValue(secret, "secretName"))
+			items := mappingValue(secret, "items")
+			if items == nil || len(items.Content) == 0 {
+				usages = append(usages, secretUsage{Secret: secretName, Field: "volume", Line: secret.Line})
+				continue
+			}
+			for _, item := range items.Content {
+				usages = append(usages, secretUsage{
+					Secret:   secretName,
+					Key:      scalarValue(mappingValue(item, "key")),
+					Optional: scalarValue(mappingValue(secret, "optional")) == "true",
+					Field:    "volume",
+					Line:     item.Line,
+				})
+			}
+		}
+	}
+	return usages
+}
+
+func workloadKinds() []string {
+	var kinds []string
+	for kind := range workloadPodSpecPaths {
+		kinds = append(kinds, "kind: "+kind)
+	}
+	return kinds
+}
+
+func sortedKeys(keys map[string]bool) []string {
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
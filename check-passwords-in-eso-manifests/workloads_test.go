@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+const workloadExternalSecret = `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db
+  namespace: app
+spec:
+  secretStoreRef:
+    name: vault
+  data:
+  - secretKey: password
+    remoteRef:
+      key: app/db
+      property: DB_PASSWORD
+  - secretKey: user
+    remoteRef:
+      key: app/db
+      property: DB_USER
+`
+
+// workloadDeployment - Deployment с secretKeyRef на ключ key Secret db. namespace пустой - его проставит kustomize
+func workloadDeployment(namespace string, key string) string {
+	metadata := "  name: api\n"
+	if namespace != "" {
+		metadata += "  namespace: " + namespace + "\n"
+	}
+	return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+` + metadata + `spec:
+  template:
+    spec:
+      containers:
+      - name: api
+        env:
+        - name: DB_PASSWORD
+          valueFrom:
+            secretKeyRef:
+              name: db
+              key: ` + key + `
+`
+}
+
+func workloadFindings(externalSecretFile string, deploymentFile string, deployment string) []Finding {
+	es := decodeExternalSecrets(ManifestSource{File: externalSecretFile, Content: []byte(workloadExternalSecret)})[0]
+	targets := NewTargetIndex()
+	targets.RegisterStatic(es)
+
+	report := &Report{}
+	all := func(ManifestSource) bool { return true }
+	checkWorkloadSecretRefs([]ManifestSource{{File: deploymentFile, Content: []byte(deployment)}}, targets, all, func(ExternalSecret) bool { return true }, report)
+	return report.Failures()
+}
+
+func TestCheckWorkloadSecretRefs(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		esFile     string
+		deployFile string
+		namespace  string
+		key        string
+		reasons    []FailureReason
+	}{
+		{"namespace совпадает", "apps/app/es.yaml", "other/deploy.yaml", "app", "password", []FailureReason{ReasonKeyUnused}},
+		{"нет ключа", "apps/app/es.yaml", "apps/app/deploy.yaml", "app", "pasword", []FailureReason{ReasonKeyNotProduced, ReasonKeyUnused, ReasonKeyUnused}},
+		// namespace нагрузки проставит kustomize, а у ExternalSecret он указан явно
+		{"нагрузка без namespace в папке ExternalSecret", "apps/app/es.yaml", "apps/app/deploy.yaml", "", "pasword", []FailureReason{ReasonKeyNotProduced, ReasonKeyUnused, ReasonKeyUnused}},
+		{"нагрузка без namespace в другой папке", "apps/app/es.yaml", "apps/other/deploy.yaml", "", "pasword", nil},
+		{"другой namespace в той же папке", "apps/app/es.yaml", "apps/app/deploy.yaml", "other", "pasword", nil},
+	} {
+		findings := workloadFindings(tc.esFile, tc.deployFile, workloadDeployment(tc.namespace, tc.key))
+		if len(findings) != len(tc.reasons) {
+			t.Errorf("%s: %+v", tc.name, findings)
+			continue
+		}
+		for i, f := range findings {
+			if f.Reason != tc.reasons[i] {
+				t.Errorf("%s: замечание %d: %+v", tc.name, i, f)
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -8,13 +10,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -29,14 +32,34 @@ type Event struct {
 	Time time.Time `json:"time"`
 }
 
+// shutdownTimeout - сколько ждать остановки по SIGTERM. Должно быть меньше terminationGracePeriodSeconds в deployment.yaml
+const shutdownTimeout = 30 * time.Second
+
 type DBConn struct {
 	DB_HOST, DB_NAME, DB_PORT string
 	DB_USER, DB_PASS, CACERT  string
 	DB_TABLE                  string
+	DB_ENGINE, DB_CLUSTER     string
+	TTL_DAYS                  int
 	BATCH                     int
+	QUEUE_SIZE                int
+	FLUSH_INTERVAL            time.Duration
+	GZIP_MIN_SIZE             int
+	SPOOL_DIR                 string
+	SPOOL_MAX_SIZE            int64
+	RETRY_MAX_INTERVAL        time.Duration
 	certpool                  *x509.CertPool
 	conn                      *http.Client
-	Events                    []Event
+	// queue - очередь событий от обработчиков, читает её только writer
+	queue chan Event
+	// queueMu защищает queue от отправки после закрытия: обработчики пишут под RLock, StopWriter закрывает под Lock
+	queueMu sync.RWMutex
+	stopped bool
+	// done закрывается, когда writer сохранил остаток событий и завершился
+	done       chan struct{}
+	spool      *Spool
+	senderStop chan struct{}
+	senderDone chan struct{}
 }
 
 func (dbconn *DBConn) Connect() {
@@ -46,6 +69,8 @@ func (dbconn *DBConn) Connect() {
 	dbconn.certpool.AppendCertsFromPEM([]byte(dbconn.CACERT))
 	log.Println("Инициализирую http клиента")
 	dbconn.conn = &http.Client{
+		// запрос должен укладываться в остановку пода: shutdownTimeout меньше terminationGracePeriodSeconds
+		Timeout: 20 * time.Second,
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				RootCAs: dbconn.certpool,
@@ -63,20 +88,154 @@ func (dbconn *DBConn) SetVariables() {
 	dbconn.DB_USER = getVariable("DB_USER", true)
 	dbconn.DB_PASS = getVariable("DB_PASS", true)
 	dbconn.CACERT = getVariable("CACERT", true)
+	dbconn.DB_ENGINE = getVariableOrDefault("DB_ENGINE", "MergeTree")
+	if dbconn.DB_ENGINE != "MergeTree" && dbconn.DB_ENGINE != "ReplicatedMergeTree" {
+		log.Fatal("Переменная DB_ENGINE должна быть MergeTree или ReplicatedMergeTree")
+	}
+	// кластер для ON CLUSTER в DDL, пустой - DDL только на этом сервере
+	dbconn.DB_CLUSTER = getVariable("DB_CLUSTER", false)
 	dbconn.BATCH, _ = strconv.Atoi(getVariable("BATCH", true))
+	if dbconn.BATCH < 1 {
+		log.Fatal("Переменная BATCH должна быть положительным числом")
+	}
+	var err error
+	// 0 - хранить события без ограничения
+	dbconn.TTL_DAYS, err = strconv.Atoi(getVariableOrDefault("TTL_DAYS", "90"))
+	if err != nil || dbconn.TTL_DAYS < 0 {
+		log.Fatal("Переменная TTL_DAYS должна быть неотрицательным числом дней")
+	}
+	dbconn.QUEUE_SIZE, err = strconv.Atoi(getVariableOrDefault("QUEUE_SIZE", strconv.Itoa(dbconn.BATCH*10)))
+	if err != nil || dbconn.QUEUE_SIZE < 1 {
+		log.Fatal("Переменная QUEUE_SIZE должна быть положительным числом")
+	}
+	dbconn.FLUSH_INTERVAL, err = time.ParseDuration(getVariableOrDefault("FLUSH_INTERVAL", "30s"))
+	if err != nil || dbconn.FLUSH_INTERVAL <= 0 {
+		log.Fatal("Переменная FLUSH_INTERVAL должна быть длительностью, например 30s или 5m")
+	}
+	// 0 - не сжимать запросы
+	dbconn.GZIP_MIN_SIZE, err = strconv.Atoi(getVariableOrDefault("GZIP_MIN_SIZE", "65536"))
+	if err != nil || dbconn.GZIP_MIN_SIZE < 0 {
+		log.Fatal("Переменная GZIP_MIN_SIZE должна быть неотрицательным числом")
+	}
+	dbconn.SPOOL_DIR = getVariableOrDefault("SPOOL_DIR", "/var/spool/k8s-events-webhook")
+	// 0 - без ограничения
+	dbconn.SPOOL_MAX_SIZE, err = strconv.ParseInt(getVariableOrDefault("SPOOL_MAX_SIZE", "536870912"), 10, 64)
+	if err != nil || dbconn.SPOOL_MAX_SIZE < 0 {
+		log.Fatal("Переменная SPOOL_MAX_SIZE должна быть неотрицательным числом байт")
+	}
+	dbconn.RETRY_MAX_INTERVAL, err = time.ParseDuration(getVariableOrDefault("RETRY_MAX_INTERVAL", "5m"))
+	if err != nil || dbconn.RETRY_MAX_INTERVAL < time.Second {
+		log.Fatal("Переменная RETRY_MAX_INTERVAL должна быть длительностью не меньше 1s")
+	}
+}
+
+// StartWriter открывает спул, создаёт очередь событий и запускает единственную горутину, которая собирает их в пачки,
+// и горутину, которая отправляет пачки из спула в БД
+func (dbconn *DBConn) StartWriter() {
+	log.Println("Открываю спул " + dbconn.SPOOL_DIR)
+	spool, err := OpenSpool(dbconn.SPOOL_DIR, dbconn.SPOOL_MAX_SIZE)
+	if err != nil {
+		log.Fatal("Не удалось открыть спул: " + err.Error())
+	}
+	dbconn.spool = spool
+	dbconn.upgradeSpool()
+	dbconn.queue = make(chan Event, dbconn.QUEUE_SIZE)
+	dbconn.done = make(chan struct{})
+	dbconn.senderStop = make(chan struct{})
+	dbconn.senderDone = make(chan struct{})
+	go dbconn.writer()
+	go dbconn.sender(dbconn.senderStop, dbconn.senderDone)
+}
+
+// StopWriter закрывает очередь, ждёт, пока writer сохранит накопленные события, и даёт sender отправить спул
+// до истечения ctx. Неотправленные пачки остаются в спуле до следующего запуска.
+// Обработчики, которые ещё выполняются (Shutdown http сервера не дождался их), после этого отвечают 503
+func (dbconn *DBConn) StopWriter(ctx context.Context) {
+	dbconn.queueMu.Lock()
+	dbconn.stopped = true
+	close(dbconn.queue)
+	dbconn.queueMu.Unlock()
+	<-dbconn.done
+	close(dbconn.senderStop)
+	select {
+	case <-dbconn.senderDone:
+	case <-ctx.Done():
+		log.Printf("Не успели отправить спул до остановки, в нём осталось %d пачек, они будут отправлены после перезапуска\n", len(dbconn.spool.Batches()))
+	}
+}
+
+// writer копит события из очереди и сохраняет их пачкой в спул, когда набралось BATCH событий
+// или с первого события в пачке прошло FLUSH_INTERVAL
+func (dbconn *DBConn) writer() {
+	defer close(dbconn.done)
+	events := make([]Event, 0, dbconn.BATCH)
+	timer := time.NewTimer(dbconn.FLUSH_INTERVAL)
+	timer.Stop()
+	flush := func(cause string) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if len(events) == 0 {
+			return
+		}
+		log.Println("Сохраняем накопленные данные в количестве " + strconv.Itoa(len(events)) + " событий в спул (" + cause + ")")
+		token, body := newDeduplicationToken(), dbconn.PrepareEventsAsJSONEachRow(events)
+		if err := dbconn.spool.Write(token, body); err != nil {
+			log.Println("Не удалось сохранить пачку в спул, отправляем в БД напрямую: " + err.Error())
+			if err := dbconn.SendDataToClickHouseDB(body, token); err != nil {
+				log.Printf("Не удалось отправить %d событий в БД, они потеряны: %v\n", len(events), err)
+			}
+		}
+		events = make([]Event, 0, dbconn.BATCH)
+	}
+	for {
+		select {
+		case event, ok := <-dbconn.queue:
+			if !ok {
+				flush("завершение работы")
+				return
+			}
+			events = append(events, event)
+			if len(events) == 1 {
+				timer.Reset(dbconn.FLUSH_INTERVAL)
+			}
+			if len(events) >= dbconn.BATCH {
+				flush("набран BATCH")
+			}
+		case <-timer.C:
+			flush("прошло FLUSH_INTERVAL")
+		}
+	}
 }
 
 func (dbconn *DBConn) handler(w http.ResponseWriter, r *http.Request) {
-	b, _ := io.ReadAll(r.Body)
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Не удалось прочитать тело запроса", http.StatusBadRequest)
+		return
+	}
 	event := Event{}
-	err := json.Unmarshal(b, &event)
-	checkError(err)
-	// log.Printf("В слайсе %v элемент(а/ов)\n", len(dbconn.Events)+1)
-	dbconn.Events = append(dbconn.Events, event)
-	if len(dbconn.Events) >= dbconn.BATCH {
-		log.Println("Отправляем накопленные данные в количестве " + strconv.Itoa(dbconn.BATCH) + " событий в БД и очищаем структуру")
-		dbconn.SendDataToClickHouseDB()
-		dbconn.Events = nil
+	if err := json.Unmarshal(b, &event); err != nil {
+		log.Println("Не удалось разобрать событие: " + err.Error())
+		http.Error(w, "Некорректное событие: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dbconn.queueMu.RLock()
+	defer dbconn.queueMu.RUnlock()
+	if dbconn.stopped {
+		http.Error(w, "Сервис останавливается", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case dbconn.queue <- event:
+	default:
+		// очередь заполнена - просим kubewatch повторить запрос, когда writer освободит место
+		log.Println("Очередь событий заполнена, отвечаем 503")
+		w.Header().Set("Retry-After", strconv.Itoa(int((dbconn.FLUSH_INTERVAL+time.Second-1)/time.Second)))
+		http.Error(w, "Очередь событий заполнена", http.StatusServiceUnavailable)
 	}
 }
 
@@ -91,63 +250,172 @@ DB_HOST=`+dbconn.DB_HOST+`
 DB_PORT=`+dbconn.DB_PORT+`
 DB_NAME=`+dbconn.DB_NAME+`
 DB_TABLE=`+dbconn.DB_TABLE+`
+DB_ENGINE=`+dbconn.DB_ENGINE+`
+DB_CLUSTER=`+dbconn.DB_CLUSTER+`
+TTL_DAYS=`+strconv.Itoa(dbconn.TTL_DAYS)+`
 DB_USER=`+dbconn.DB_USER+`
 DB_PASS=[masked]
 CACERT=YandexRootCA
 BATCH=`+strconv.Itoa(dbconn.BATCH)+`
+QUEUE_SIZE=`+strconv.Itoa(dbconn.QUEUE_SIZE)+`
+FLUSH_INTERVAL=`+dbconn.FLUSH_INTERVAL.String()+`
+GZIP_MIN_SIZE=`+strconv.Itoa(dbconn.GZIP_MIN_SIZE)+`
+SPOOL_DIR=`+dbconn.SPOOL_DIR+`
+SPOOL_MAX_SIZE=`+strconv.FormatInt(dbconn.SPOOL_MAX_SIZE, 10)+`
+RETRY_MAX_INTERVAL=`+dbconn.RETRY_MAX_INTERVAL.String()+`
+
+Событий в очереди: `+strconv.Itoa(len(dbconn.queue))+`
+Пачек в спуле: `+strconv.Itoa(len(dbconn.spool.Batches()))+` (`+strconv.FormatInt(dbconn.spool.Size(), 10)+` байт)
 
 `)
 
 }
 
-func (dbconn *DBConn) PrepareEventsAsString() string {
-	var values string
-	for _, m := range dbconn.Events {
-		values = values + "('" + m.Eventmeta.Kind + "','" + m.Eventmeta.Name + "','" + m.Eventmeta.Namespace + "','" + m.Eventmeta.Reason + "','" + m.Text + "','" + strconv.FormatInt(m.Time.UnixNano(), 10) + "'),"
+// eventTimeFormat - формат колонки time DateTime64(9) в JSONEachRow
+const eventTimeFormat = "2006-01-02 15:04:05.000000000"
+
+// EventRow - строка таблицы в формате JSONEachRow
+type EventRow struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Reason    string `json:"reason"`
+	Text      string `json:"text"`
+	Time      string `json:"time"`
+}
+
+// PrepareEventsAsJSONEachRow кодирует события по одному JSON объекту на строку. Экранированием занимается encoding/json,
+// поэтому кавычки и переводы строк в тексте события не ломают запрос
+func (dbconn *DBConn) PrepareEventsAsJSONEachRow(events []Event) []byte {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(false)
+	for _, m := range events {
+		err := encoder.Encode(EventRow{
+			Kind:      m.Eventmeta.Kind,
+			Name:      m.Eventmeta.Name,
+			Namespace: m.Eventmeta.Namespace,
+			Reason:    m.Eventmeta.Reason,
+			Text:      m.Text,
+			Time:      m.Time.UTC().Format(eventTimeFormat),
+		})
+		checkError(err)
 	}
-	return values
+	return body.Bytes()
+}
+
+// quoteIdentifier экранирует имя базы или таблицы для подстановки в запрос
+func quoteIdentifier(name string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
+
+// TableName - полное имя таблицы из DB_NAME и DB_TABLE
+func (dbconn *DBConn) TableName() string {
+	return quoteIdentifier(dbconn.DB_NAME) + "." + quoteIdentifier(dbconn.DB_TABLE)
 }
 
-func (dbconn *DBConn) SendHTTPRequest(m string, q string) string {
-	req, _ := http.NewRequest(m, fmt.Sprintf("https://%s:%s/", dbconn.DB_HOST, dbconn.DB_PORT), nil)
+// SendHTTPRequest выполняет запрос q с настройками settings. Данные для INSERT передаются в body,
+// начиная с GZIP_MIN_SIZE байт они сжимаются. Ответ не 200 возвращается как ошибка с текстом от ClickHouse
+func (dbconn *DBConn) SendHTTPRequest(m string, q string, body []byte, settings map[string]string) (string, error) {
+	compressed := false
+	if dbconn.GZIP_MIN_SIZE > 0 && len(body) >= dbconn.GZIP_MIN_SIZE {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(body)
+		checkError(err)
+		checkError(zw.Close())
+		body, compressed = buf.Bytes(), true
+	}
+	req, _ := http.NewRequest(m, fmt.Sprintf("https://%s:%s/", dbconn.DB_HOST, dbconn.DB_PORT), bytes.NewReader(body))
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	query := req.URL.Query()
 	query.Add("database", dbconn.DB_NAME)
 	query.Add("query", q)
+	for k, v := range settings {
+		query.Add(k, v)
+	}
 	req.URL.RawQuery = query.Encode()
 	req.Header.Add("X-ClickHouse-User", dbconn.DB_USER)
 	req.Header.Add("X-ClickHouse-Key", dbconn.DB_PASS)
 	resp, err := dbconn.conn.Do(req)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	checkError(err)
-	return string(data)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(data))
+		return string(data), &ClickHouseError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Code:       clickHouseErrorCode(resp.Header.Get("X-ClickHouse-Exception-Code"), message),
+			Message:    message,
+		}
+	}
+	return string(data), nil
 }
 
-func (dbconn *DBConn) IsTableExist() bool {
-	log.Println("Проверяю существует ли таблица")
-	data := dbconn.SendHTTPRequest("GET", "Exists table "+dbconn.DB_NAME+"."+dbconn.DB_TABLE)
-	ret, err := strconv.Atoi(strings.Trim(string(data), "\n"))
-	checkError(err)
-	if ret == 0 {
-		log.Println("Таблица не существует.")
-		return false
-	} else {
-		log.Println("Таблица существует")
-		return true
-	}
+// ClickHouseError - ответ ClickHouse с кодом не 200
+type ClickHouseError struct {
+	StatusCode int
+	Status     string
+	// Code - код исключения ClickHouse из X-ClickHouse-Exception-Code или из текста "Code: N. DB::Exception: ...", 0 если его нет
+	Code    int
+	Message string
+}
+
+func (e *ClickHouseError) Error() string {
+	return "ClickHouse ответил " + e.Status + ": " + e.Message
+}
+
+// dataErrorCodes - коды ClickHouse, с которыми отвергаются сами данные пачки: ошибки разбора и несовпадение типов
+var dataErrorCodes = map[int]bool{
+	6:   true, // CANNOT_PARSE_TEXT
+	25:  true, // CANNOT_PARSE_ESCAPE_SEQUENCE
+	26:  true, // CANNOT_PARSE_QUOTED_STRING
+	27:  true, // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	38:  true, // CANNOT_PARSE_DATE
+	41:  true, // CANNOT_PARSE_DATETIME
+	53:  true, // TYPE_MISMATCH
+	70:  true, // CANNOT_CONVERT_TYPE
+	72:  true, // CANNOT_PARSE_NUMBER
+	117: true, // INCORRECT_DATA
+	131: true, // TOO_LARGE_STRING_SIZE
+	321: true, // VALUE_IS_OUT_OF_RANGE_OF_DATA_TYPE
+}
+
+// Permanent - повтор запроса не поможет: ClickHouse ответил 400 и отверг данные пачки. Остальные ошибки,
+// в том числе 401/403 после смены пароля или прав и 404 для ещё не созданной таблицы, повторяются
+func (e *ClickHouseError) Permanent() bool {
+	return e.StatusCode == http.StatusBadRequest && dataErrorCodes[e.Code]
 }
 
-func (dbconn *DBConn) CreateTable() {
-	log.Println("Пробую создать")
-	_ = dbconn.SendHTTPRequest("POST", "CREATE TABLE "+dbconn.DB_NAME+"."+dbconn.DB_TABLE+" (`kind` String, `name` String, `namespace` String, `reason` String, `text` String, `time` Int64) ENGINE = Log;")
-	log.Println("Таблица создана")
+// clickHouseErrorCode достаёт код исключения из заголовка ответа или из начала текста ошибки
+func clickHouseErrorCode(header string, message string) int {
+	if code, err := strconv.Atoi(header); err == nil {
+		return code
+	}
+	if !strings.HasPrefix(message, "Code: ") {
+		return 0
+	}
+	digits := strings.TrimPrefix(message, "Code: ")
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		digits = digits[:i]
+	}
+	code, _ := strconv.Atoi(digits)
+	return code
 }
 
-func (dbconn *DBConn) SendDataToClickHouseDB() {
-	_ = dbconn.SendHTTPRequest("POST", "INSERT INTO events (kind,name,namespace,reason,text,time) values "+dbconn.PrepareEventsAsString())
+func (dbconn *DBConn) SendDataToClickHouseDB(body []byte, token string) error {
+	_, err := dbconn.SendHTTPRequest("POST", "INSERT INTO "+dbconn.TableName()+" (kind, name, namespace, reason, text, time) FORMAT JSONEachRow", body, map[string]string{
+		"insert_deduplication_token": token,
+	})
+	return err
 }
 
 func checkError(err error) {
@@ -165,15 +433,24 @@ func getVariable(curVar string, mandatory bool) string {
 	return tmpVar
 }
 
+func getVariableOrDefault(curVar string, defaultValue string) string {
+	tmpVar := getVariable(curVar, false)
+	if len(tmpVar) == 0 {
+		return defaultValue
+	}
+	return tmpVar
+}
+
 func main() {
 	log.Println("Инициализирую структуру")
 	dbconn := DBConn{}
 	dbconn.SetVariables()
 	dbconn.Connect()
 
-	if !dbconn.IsTableExist() {
-		dbconn.CreateTable()
+	if err := dbconn.Migrate(); err != nil {
+		log.Fatal("Не удалось обновить схему таблицы: " + err.Error())
 	}
+	dbconn.StartWriter()
 	httpServer := &http.Server{
 		Addr:           ":8000",
 		ReadTimeout:    10 * time.Second,
@@ -189,15 +466,16 @@ func main() {
 	}()
 
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// остановка http сервера и отправка спула вместе укладываются в shutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
-	log.Println("Получен сигнал на прерывание отправляем накопленные данные")
-	dbconn.SendDataToClickHouseDB()
-	log.Println("Завершаем работу")
+	log.Println("Получен сигнал на прерывание, перестаём принимать события")
 	if err := httpServer.Shutdown(ctx); err != nil {
-
-		log.Fatal(err)
+		log.Println("Не удалось корректно остановить http сервер: " + err.Error())
 	}
+	log.Println("Сохраняем накопленные данные в спул и отправляем его")
+	dbconn.StopWriter(ctx)
+	log.Println("Завершаем работу")
 }
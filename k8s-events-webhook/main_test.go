@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEvent = `{"eventmeta":{"kind":"pod","name":"api-1","namespace":"app","reason":"created"},"text":"pod created","time":"2024-01-02T03:04:05.123456789Z"}`
+
+// testWriter - DBConn со спулом во временном каталоге и запущенным writer, без sender и ClickHouse
+func testWriter(t *testing.T, batch int, flushInterval time.Duration, queueSize int) *DBConn {
+	t.Helper()
+	spool, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbconn := &DBConn{BATCH: batch, FLUSH_INTERVAL: flushInterval, QUEUE_SIZE: queueSize, spool: spool}
+	dbconn.queue = make(chan Event, queueSize)
+	dbconn.done = make(chan struct{})
+	go dbconn.writer()
+	return dbconn
+}
+
+func postEvent(dbconn *DBConn, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	dbconn.handler(w, httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+	return w
+}
+
+// waitBatches ждёт, пока в спуле окажется want пачек
+func waitBatches(t *testing.T, spool *Spool, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(spool.Batches()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("пачек в спуле %d, ожидали %d", len(spool.Batches()), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWriterFlushOnBatch(t *testing.T) {
+	dbconn := testWriter(t, 3, time.Hour, 10)
+	for i := 0; i < 3; i++ {
+		if w := postEvent(dbconn, testEvent); w.Code != http.StatusOK {
+			t.Fatalf("ответ %d: %s", w.Code, w.Body)
+		}
+	}
+	waitBatches(t, dbconn.spool, 1)
+	body, _, err := dbconn.spool.Read(dbconn.spool.Batches()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(body), "\n"); lines != 3 {
+		t.Errorf("строк в пачке %d, ожидали 3", lines)
+	}
+}
+
+func TestWriterFlushOnInterval(t *testing.T) {
+	dbconn := testWriter(t, 100, 50*time.Millisecond, 10)
+	postEvent(dbconn, testEvent)
+	waitBatches(t, dbconn.spool, 1)
+	// таймер запускается заново с первым событием следующей пачки
+	postEvent(dbconn, testEvent)
+	waitBatches(t, dbconn.spool, 2)
+}
+
+func TestHandlerQueueFull(t *testing.T) {
+	dbconn := &DBConn{FLUSH_INTERVAL: 1500 * time.Millisecond, queue: make(chan Event, 1)}
+	if w := postEvent(dbconn, testEvent); w.Code != http.StatusOK {
+		t.Fatalf("ответ %d: %s", w.Code, w.Body)
+	}
+	w := postEvent(dbconn, testEvent)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("при заполненной очереди: %d, Retry-After=%q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := postEvent(dbconn, "{"); w.Code != http.StatusBadRequest {
+		t.Errorf("некорректное событие: %d", w.Code)
+	}
+}
+
+func TestHandlerAfterStop(t *testing.T) {
+	dbconn := testWriter(t, 100, time.Hour, 10)
+	postEvent(dbconn, testEvent)
+	dbconn.senderStop = make(chan struct{})
+	dbconn.senderDone = make(chan struct{})
+	close(dbconn.senderDone)
+	dbconn.StopWriter(context.Background())
+	// остаток очереди сохранён в спул, а поздний запрос не паникует на закрытом канале
+	waitBatches(t, dbconn.spool, 1)
+	if w := postEvent(dbconn, testEvent); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("после остановки: %d", w.Code)
+	}
+}
+
+func TestPrepareEventsAsJSONEachRow(t *testing.T) {
+	event := Event{Text: "строка \"в кавычках\"\nи <тег> \\ обратная черта"}
+	event.Eventmeta.Kind = "pod"
+	event.Eventmeta.Namespace = "app"
+	event.Time = time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.FixedZone("MSK", 3*3600))
+	body := (&DBConn{}).PrepareEventsAsJSONEachRow([]Event{event, event})
+
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("строк %d, ожидали по одной на событие:\n%s", len(lines), body)
+	}
+	want := `{"kind":"pod","name":"","namespace":"app","reason":"","text":"строка \"в кавычках\"\nи <тег> \\ обратная черта","time":"2024-01-02 00:04:05.123456789"}`
+	if lines[0] != want {
+		t.Errorf("строка:\n%s\nожидали:\n%s", lines[0], want)
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	for name, want := range map[string]string{
+		"events":       "`events`",
+		"my`table":     "`my\\`table`",
+		"a\\b":         "`a\\\\b`",
+		"x` ; DROP --": "`x\\` ; DROP --`",
+	} {
+		if got := quoteIdentifier(name); got != want {
+			t.Errorf("quoteIdentifier(%q) = %s, ожидали %s", name, got, want)
+		}
+	}
+	if got := (&DBConn{DB_NAME: "k8s", DB_TABLE: "events"}).TableName(); got != "`k8s`.`events`" {
+		t.Errorf("TableName() = %s", got)
+	}
+}
+
+// testClickHouse - DBConn, который отправляет запросы в TLS сервер handler
+func testClickHouse(t *testing.T, handler http.HandlerFunc) *DBConn {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	host, port, _ := strings.Cut(strings.TrimPrefix(server.URL, "https://"), ":")
+	return &DBConn{DB_HOST: host, DB_PORT: port, DB_NAME: "k8s", DB_TABLE: "events", conn: server.Client()}
+}
+
+func TestSendHTTPRequestGzip(t *testing.T) {
+	var encoding, query, token string
+	var received []byte
+	dbconn := testClickHouse(t, func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		query = r.URL.Query().Get("query")
+		token = r.URL.Query().Get("insert_deduplication_token")
+		var reader io.Reader = r.Body
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			reader = zr
+		}
+		received, _ = io.ReadAll(reader)
+	})
+	dbconn.GZIP_MIN_SIZE = 100
+
+	for _, tc := range []struct {
+		size     int
+		encoding string
+	}{{99, ""}, {100, "gzip"}, {1000, "gzip"}} {
+		body := []byte(strings.Repeat("x", tc.size))
+		if err := dbconn.SendDataToClickHouseDB(body, "token-1"); err != nil {
+			t.Fatal(err)
+		}
+		if encoding != tc.encoding || string(received) != string(body) {
+			t.Errorf("%d байт: Content-Encoding=%q, получено %d байт", tc.size, encoding, len(received))
+		}
+	}
+	if token != "token-1" || !strings.HasPrefix(query, "INSERT INTO `k8s`.`events` (kind, name, namespace, reason, text, time) FORMAT JSONEachRow") {
+		t.Errorf("запрос %q, токен %q", query, token)
+	}
+
+	dbconn.GZIP_MIN_SIZE = 0
+	if err := dbconn.SendDataToClickHouseDB([]byte(strings.Repeat("x", 1000)), "token-2"); err != nil || encoding != "" {
+		t.Errorf("GZIP_MIN_SIZE=0 не должен сжимать: %q, %v", encoding, err)
+	}
+}
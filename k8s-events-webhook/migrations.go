@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Migration - версия схемы таблицы событий. Применённые версии записываются в таблицу <DB_TABLE>_schema_migrations
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(dbconn *DBConn) error
+}
+
+// migrations применяются по возрастанию версии, уже применённые не выполняются повторно.
+// Новые изменения схемы добавляются в конец списка, старые не меняются
+var migrations = []Migration{
+	{Version: 1, Description: "таблица MergeTree с партициями по дням и TTL, время в DateTime64", Apply: migrateToMergeTree},
+	{Version: 2, Description: "дедупликация вставок в таблице MergeTree, созданной до версии 1", Apply: enableDeduplication},
+}
+
+// deduplicationWindow - сколько последних вставок помнит MergeTree для insert_deduplication_token
+const deduplicationWindow = "1000"
+
+// queryParameters передаёт пары имя, значение как параметры запроса {имя:Тип}, чтобы не подставлять строки в SQL
+func queryParameters(params []string) map[string]string {
+	settings := map[string]string{}
+	for i := 0; i+1 < len(params); i += 2 {
+		settings["param_"+params[i]] = params[i+1]
+	}
+	return settings
+}
+
+// exec выполняет запрос без результата
+func (dbconn *DBConn) exec(q string, params ...string) error {
+	_, err := dbconn.SendHTTPRequest("POST", q, nil, queryParameters(params))
+	return err
+}
+
+// queryValue выполняет запрос, который возвращает одно значение
+func (dbconn *DBConn) queryValue(q string, params ...string) (string, error) {
+	data, err := dbconn.SendHTTPRequest("POST", q+" FORMAT TabSeparatedRaw", nil, queryParameters(params))
+	return strings.TrimRight(data, "\n"), err
+}
+
+func (dbconn *DBConn) onCluster() string {
+	if dbconn.DB_CLUSTER == "" {
+		return ""
+	}
+	return " ON CLUSTER " + quoteIdentifier(dbconn.DB_CLUSTER)
+}
+
+// tableClauses - движок из DB_ENGINE с ключами keys и настройками settings. Для MergeTree включается дедупликация
+// вставок по insert_deduplication_token, у ReplicatedMergeTree она включена по умолчанию.
+// ReplicatedMergeTree создаётся без аргументов, путь в ZooKeeper берётся из default_replica_path сервера
+func (dbconn *DBConn) tableClauses(keys string, settings ...string) string {
+	if dbconn.DB_ENGINE == "MergeTree" {
+		settings = append([]string{"non_replicated_deduplication_window = " + deduplicationWindow}, settings...)
+	}
+	clauses := "ENGINE = " + dbconn.DB_ENGINE + " " + keys
+	if len(settings) > 0 {
+		clauses += " SETTINGS " + strings.Join(settings, ", ")
+	}
+	return clauses
+}
+
+// ttlExpression - TTL таблицы событий из TTL_DAYS, пустая строка - хранить без ограничения
+func (dbconn *DBConn) ttlExpression() string {
+	if dbconn.TTL_DAYS == 0 {
+		return ""
+	}
+	return "toDateTime(time) + toIntervalDay(" + strconv.Itoa(dbconn.TTL_DAYS) + ")"
+}
+
+// tableEngine возвращает движок существующей таблицы или пустую строку, если таблицы нет
+func (dbconn *DBConn) tableEngine(table string) (string, error) {
+	return dbconn.queryValue("SELECT engine FROM system.tables WHERE database = {database:String} AND name = {table:String}",
+		"database", dbconn.DB_NAME, "table", table)
+}
+
+// tableEngineFull возвращает описание движка таблицы событий с ключами, TTL и настройками
+func (dbconn *DBConn) tableEngineFull() (string, error) {
+	return dbconn.queryValue("SELECT engine_full FROM system.tables WHERE database = {database:String} AND name = {table:String}",
+		"database", dbconn.DB_NAME, "table", dbconn.DB_TABLE)
+}
+
+// createEventsTable создаёт таблицу событий table в текущей схеме (версия 1)
+func (dbconn *DBConn) createEventsTable(table string) error {
+	q := "CREATE TABLE IF NOT EXISTS " + quoteIdentifier(dbconn.DB_NAME) + "." + quoteIdentifier(table) + dbconn.onCluster() + ` (
+	kind LowCardinality(String),
+	name String,
+	namespace LowCardinality(String),
+	reason LowCardinality(String),
+	text String,
+	time DateTime64(9, 'UTC')
+) `
+	keys := "PARTITION BY toDate(time) ORDER BY (namespace, kind, time)"
+	if ttl := dbconn.ttlExpression(); ttl != "" {
+		// с партициями по дням TTL удаляет партиции целиком, без перезаписи кусков
+		q += dbconn.tableClauses(keys+" TTL "+ttl, "ttl_only_drop_parts = 1")
+	} else {
+		q += dbconn.tableClauses(keys)
+	}
+	return dbconn.exec(q)
+}
+
+// migrateToMergeTree создаёт таблицу событий. Таблица ENGINE = Log от прошлых версий вебхука переносится в новую,
+// старая остаётся рядом под именем <DB_TABLE>_log_backup
+func migrateToMergeTree(dbconn *DBConn) error {
+	engine, err := dbconn.tableEngine(dbconn.DB_TABLE)
+	if err != nil {
+		return err
+	}
+	switch {
+	case engine == "":
+		return dbconn.createEventsTable(dbconn.DB_TABLE)
+	case strings.HasSuffix(engine, "MergeTree"):
+		log.Println("Таблица уже на движке " + engine + ", создавать не нужно")
+		return nil
+	case engine != "Log":
+		return fmt.Errorf("таблица %s на движке %s, перенос поддерживается только для Log", dbconn.TableName(), engine)
+	}
+
+	log.Println("Таблица на движке Log, переносим события в MergeTree")
+	staging, backup := dbconn.DB_TABLE+"_mergetree", dbconn.DB_TABLE+"_log_backup"
+	if err := dbconn.exec("DROP TABLE IF EXISTS " + quoteIdentifier(dbconn.DB_NAME) + "." + quoteIdentifier(staging) + dbconn.onCluster()); err != nil {
+		return err
+	}
+	if err := dbconn.createEventsTable(staging); err != nil {
+		return err
+	}
+	if err := dbconn.exec("INSERT INTO " + quoteIdentifier(dbconn.DB_NAME) + "." + quoteIdentifier(staging) +
+		" (kind, name, namespace, reason, text, time) SELECT kind, name, namespace, reason, text, fromUnixTimestamp64Nano(time, 'UTC') FROM " + dbconn.TableName()); err != nil {
+		return err
+	}
+	log.Println("События перенесены, старая таблица будет переименована в " + backup)
+	return dbconn.exec("RENAME TABLE " + dbconn.TableName() + " TO " + quoteIdentifier(dbconn.DB_NAME) + "." + quoteIdentifier(backup) +
+		", " + quoteIdentifier(dbconn.DB_NAME) + "." + quoteIdentifier(staging) + " TO " + dbconn.TableName() + dbconn.onCluster())
+}
+
+// enableDeduplication включает non_replicated_deduplication_window у таблицы MergeTree, которую migrateToMergeTree
+// оставила как есть. Без неё повтор пачки из спула с тем же insert_deduplication_token вставляется второй раз.
+// У Replicated* таблиц дедупликация включена всегда
+func enableDeduplication(dbconn *DBConn) error {
+	engine, err := dbconn.tableEngine(dbconn.DB_TABLE)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(engine, "MergeTree") || strings.HasPrefix(engine, "Replicated") {
+		return nil
+	}
+	engineFull, err := dbconn.tableEngineFull()
+	if err != nil {
+		return err
+	}
+	if strings.Contains(engineFull, "non_replicated_deduplication_window") {
+		return nil
+	}
+	log.Println("Включаю дедупликацию вставок в таблице " + engine)
+	return dbconn.exec("ALTER TABLE " + dbconn.TableName() + dbconn.onCluster() + " MODIFY SETTING non_replicated_deduplication_window = " + deduplicationWindow)
+}
+
+// Migrate применяет к таблице событий миграции, которых ещё нет в <DB_TABLE>_schema_migrations,
+// и приводит TTL таблицы к TTL_DAYS
+func (dbconn *DBConn) Migrate() error {
+	log.Println("Проверяю схему таблицы")
+	versions := quoteIdentifier(dbconn.DB_NAME) + "." + quoteIdentifier(dbconn.DB_TABLE+"_schema_migrations")
+	if err := dbconn.exec("CREATE TABLE IF NOT EXISTS " + versions + dbconn.onCluster() +
+		" (version UInt32, description String, applied_at DateTime DEFAULT now()) " + dbconn.tableClauses("ORDER BY version")); err != nil {
+		return err
+	}
+	value, err := dbconn.queryValue("SELECT max(version) FROM " + versions)
+	if err != nil {
+		return err
+	}
+	current, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("не удалось прочитать версию схемы %q: %v", value, err)
+	}
+	log.Printf("Текущая версия схемы: %d, последняя: %d\n", current, migrations[len(migrations)-1].Version)
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		log.Printf("Применяю миграцию %d: %s\n", m.Version, m.Description)
+		if err := m.Apply(dbconn); err != nil {
+			return fmt.Errorf("миграция %d: %v", m.Version, err)
+		}
+		if err := dbconn.exec("INSERT INTO "+versions+" (version, description) SELECT {version:UInt32}, {description:String}",
+			"version", strconv.Itoa(m.Version), "description", m.Description); err != nil {
+			return err
+		}
+	}
+	return dbconn.ensureTTL()
+}
+
+// ensureTTL меняет TTL таблицы, если TTL_DAYS изменился после её создания
+func (dbconn *DBConn) ensureTTL() error {
+	engineFull, err := dbconn.tableEngineFull()
+	if err != nil {
+		return err
+	}
+	ttl := dbconn.ttlExpression()
+	switch {
+	case ttl == "" && strings.Contains(engineFull, " TTL "):
+		log.Println("TTL_DAYS=0, убираю TTL таблицы")
+		return dbconn.exec("ALTER TABLE " + dbconn.TableName() + dbconn.onCluster() + " REMOVE TTL")
+	case ttl != "" && !strings.Contains(engineFull, "TTL "+ttl):
+		log.Println("Меняю TTL таблицы на " + ttl)
+		return dbconn.exec("ALTER TABLE " + dbconn.TableName() + dbconn.onCluster() + " MODIFY TTL " + ttl)
+	}
+	return nil
+}
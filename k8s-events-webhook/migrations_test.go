@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSchema - ответы ClickHouse на запросы Migrate и список выполненных DDL/INSERT
+type fakeSchema struct {
+	mu         sync.Mutex
+	version    string
+	engine     string
+	engineFull string
+	queries    []string
+}
+
+func (f *fakeSchema) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := r.URL.Query().Get("query")
+	switch {
+	case strings.HasPrefix(q, "SELECT max(version)"):
+		w.Write([]byte(f.version + "\n"))
+	case strings.HasPrefix(q, "SELECT engine_full"):
+		w.Write([]byte(f.engineFull + "\n"))
+	case strings.HasPrefix(q, "SELECT engine"):
+		w.Write([]byte(f.engine + "\n"))
+	default:
+		f.queries = append(f.queries, q)
+		if strings.HasPrefix(q, "RENAME TABLE") {
+			f.engine, f.engineFull = "MergeTree", "MergeTree PARTITION BY toDate(time) SETTINGS non_replicated_deduplication_window = 1000"
+		}
+	}
+}
+
+func migrate(t *testing.T, schema *fakeSchema, configure func(*DBConn)) []string {
+	t.Helper()
+	dbconn := testClickHouse(t, schema.handle)
+	dbconn.DB_ENGINE = "MergeTree"
+	dbconn.TTL_DAYS = 90
+	if configure != nil {
+		configure(dbconn)
+	}
+	if err := dbconn.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return schema.queries
+}
+
+// findQuery возвращает первый запрос с префиксом prefix
+func findQuery(queries []string, prefix string) string {
+	for _, q := range queries {
+		if strings.HasPrefix(q, prefix) {
+			return q
+		}
+	}
+	return ""
+}
+
+func TestMigrateNewTable(t *testing.T) {
+	queries := migrate(t, &fakeSchema{version: "0"}, nil)
+	create := findQuery(queries, "CREATE TABLE IF NOT EXISTS `k8s`.`events` ")
+	for _, clause := range []string{
+		"time DateTime64(9, 'UTC')",
+		"ENGINE = MergeTree PARTITION BY toDate(time) ORDER BY (namespace, kind, time) TTL toDateTime(time) + toIntervalDay(90)",
+		"SETTINGS non_replicated_deduplication_window = 1000, ttl_only_drop_parts = 1",
+	} {
+		if !strings.Contains(create, clause) {
+			t.Errorf("в CREATE TABLE нет %q:\n%s", clause, create)
+		}
+	}
+	if len(findQuery(queries, "INSERT INTO `k8s`.`events_schema_migrations`")) == 0 {
+		t.Error("применённые миграции не записаны")
+	}
+}
+
+func TestMigrateLogToMergeTreeOnCluster(t *testing.T) {
+	queries := migrate(t, &fakeSchema{version: "0", engine: "Log"}, func(dbconn *DBConn) {
+		dbconn.DB_CLUSTER = "main"
+	})
+	for _, want := range []string{
+		"DROP TABLE IF EXISTS `k8s`.`events_mergetree` ON CLUSTER `main`",
+		"CREATE TABLE IF NOT EXISTS `k8s`.`events_mergetree` ON CLUSTER `main` (",
+		"INSERT INTO `k8s`.`events_mergetree` (kind, name, namespace, reason, text, time) SELECT kind, name, namespace, reason, text, fromUnixTimestamp64Nano(time, 'UTC') FROM `k8s`.`events`",
+		"RENAME TABLE `k8s`.`events` TO `k8s`.`events_log_backup`, `k8s`.`events_mergetree` TO `k8s`.`events` ON CLUSTER `main`",
+	} {
+		if findQuery(queries, want) == "" {
+			t.Errorf("нет запроса %q среди:\n%s", want, strings.Join(queries, "\n"))
+		}
+	}
+	// у перенесённой таблицы дедупликация уже включена
+	if q := findQuery(queries, "ALTER TABLE `k8s`.`events` ON CLUSTER `main` MODIFY SETTING"); q != "" {
+		t.Errorf("лишний запрос: %s", q)
+	}
+}
+
+func TestMigrateExistingMergeTreeDeduplication(t *testing.T) {
+	queries := migrate(t, &fakeSchema{version: "0", engine: "MergeTree", engineFull: "MergeTree ORDER BY time TTL toDateTime(time) + toIntervalDay(90)"}, nil)
+	if findQuery(queries, "ALTER TABLE `k8s`.`events` MODIFY SETTING non_replicated_deduplication_window = 1000") == "" {
+		t.Errorf("дедупликация не включена:\n%s", strings.Join(queries, "\n"))
+	}
+	if findQuery(queries, "CREATE TABLE IF NOT EXISTS `k8s`.`events` ") != "" {
+		t.Error("существующая таблица MergeTree не должна создаваться заново")
+	}
+
+	queries = migrate(t, &fakeSchema{version: "1", engine: "ReplicatedMergeTree", engineFull: "ReplicatedMergeTree ORDER BY time TTL toDateTime(time) + toIntervalDay(90)"}, nil)
+	if q := findQuery(queries, "ALTER TABLE"); q != "" {
+		t.Errorf("у ReplicatedMergeTree дедупликация включена всегда: %s", q)
+	}
+}
+
+func TestMigrateTTL(t *testing.T) {
+	queries := migrate(t, &fakeSchema{version: "2", engine: "MergeTree", engineFull: "MergeTree ORDER BY time TTL toDateTime(time) + toIntervalDay(90)"}, func(dbconn *DBConn) {
+		dbconn.TTL_DAYS = 30
+	})
+	if findQuery(queries, "ALTER TABLE `k8s`.`events` MODIFY TTL toDateTime(time) + toIntervalDay(30)") == "" {
+		t.Errorf("TTL не изменён:\n%s", strings.Join(queries, "\n"))
+	}
+
+	queries = migrate(t, &fakeSchema{version: "2", engine: "MergeTree", engineFull: "MergeTree ORDER BY time TTL toDateTime(time) + toIntervalDay(90)"}, func(dbconn *DBConn) {
+		dbconn.TTL_DAYS = 0
+	})
+	if findQuery(queries, "ALTER TABLE `k8s`.`events` REMOVE TTL") == "" {
+		t.Errorf("TTL не убран:\n%s", strings.Join(queries, "\n"))
+	}
+
+	queries = migrate(t, &fakeSchema{version: "2", engine: "MergeTree", engineFull: "MergeTree ORDER BY time TTL toDateTime(time) + toIntervalDay(90) SETTINGS index_granularity = 8192"}, nil)
+	if q := findQuery(queries, "ALTER TABLE"); q != "" {
+		t.Errorf("TTL не менялся, а запрос выполнен: %s", q)
+	}
+}
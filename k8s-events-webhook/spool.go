@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolExt = ".jsonl"
+
+// quarantineDir - подкаталог спула для пачек, которые ClickHouse отверг
+const quarantineDir = "quarantine"
+
+// Spool - каталог с пачками событий, которые ещё не записаны в ClickHouse. Каждая пачка - отдельный файл
+// <номер>-<токен>.jsonl в формате JSONEachRow. Номер задаёт порядок отправки, токен передаётся
+// в insert_deduplication_token, чтобы повтор уже принятой пачки не создал дублей
+type Spool struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	size    int64
+	lastSeq int64
+	// notify получает сигнал, когда в каталоге появилась новая пачка
+	notify chan struct{}
+}
+
+// OpenSpool создаёт каталог, удаляет недописанные файлы и считает объём пачек, оставшихся с прошлого запуска
+func OpenSpool(dir string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	spool := &Spool{dir: dir, maxSize: maxSize, notify: make(chan struct{}, 1)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			_ = os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), spoolExt) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			spool.size += info.Size()
+		}
+	}
+	for _, name := range spool.quarantined() {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			spool.size += info.Size()
+		}
+	}
+	if batches := spool.Batches(); len(batches) > 0 {
+		log.Printf("В спуле %s осталось %d пачек (%d байт) с прошлого запуска, отправим их первыми\n", dir, len(batches), spool.size)
+		spool.signal()
+	}
+	return spool, nil
+}
+
+// newDeduplicationToken - случайный токен пачки для insert_deduplication_token
+func newDeduplicationToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	checkError(err)
+	return hex.EncodeToString(b)
+}
+
+// Write сохраняет пачку на диск. Файл пишется во временный и переименовывается, чтобы при падении
+// не осталось обрезанной пачки. Если спул превысил maxSize, удаляются самые старые пачки: сначала из карантина,
+// потом ещё не отправленные
+func (spool *Spool) Write(token string, body []byte) error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	seq := time.Now().UnixNano()
+	if seq <= spool.lastSeq {
+		seq = spool.lastSeq + 1
+	}
+	spool.lastSeq = seq
+	name := fmt.Sprintf("%020d-%s%s", seq, token, spoolExt)
+	tmp := filepath.Join(spool.dir, name+".tmp")
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(spool.dir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	spool.size += int64(len(body))
+	for _, oldest := range append(spool.quarantined(), spool.batches()...) {
+		if spool.maxSize <= 0 || spool.size <= spool.maxSize {
+			break
+		}
+		log.Printf("Спул превысил SPOOL_MAX_SIZE=%d байт, удаляем самую старую пачку %s, её события потеряны\n", spool.maxSize, oldest)
+		spool.remove(oldest)
+	}
+	spool.signal()
+	return nil
+}
+
+func (spool *Spool) signal() {
+	select {
+	case spool.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Batches - имена файлов пачек в порядке отправки
+func (spool *Spool) Batches() []string {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return spool.batches()
+}
+
+func (spool *Spool) batches() []string {
+	entries, err := os.ReadDir(spool.dir)
+	if err != nil {
+		log.Println("Не удалось прочитать каталог спула: " + err.Error())
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), spoolExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quarantined - пути пачек в карантине относительно каталога спула, от старых к новым
+func (spool *Spool) quarantined() []string {
+	entries, err := os.ReadDir(filepath.Join(spool.dir, quarantineDir))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), spoolExt) {
+			names = append(names, filepath.Join(quarantineDir, entry.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Read возвращает содержимое пачки и её токен дедупликации
+func (spool *Spool) Read(name string) ([]byte, string, error) {
+	body, err := os.ReadFile(filepath.Join(spool.dir, name))
+	token := strings.TrimSuffix(name, spoolExt)
+	if i := strings.Index(token, "-"); i >= 0 {
+		token = token[i+1:]
+	}
+	return body, token, err
+}
+
+// Rewrite заменяет содержимое пачки, сохраняя её имя, а значит порядок отправки и токен
+func (spool *Spool) Rewrite(name string, body []byte) error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	file := filepath.Join(spool.dir, name)
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file+".tmp", body, 0o644); err != nil {
+		_ = os.Remove(file + ".tmp")
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		_ = os.Remove(file + ".tmp")
+		return err
+	}
+	spool.size += int64(len(body)) - info.Size()
+	return nil
+}
+
+// Remove удаляет отправленную пачку
+func (spool *Spool) Remove(name string) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	spool.remove(name)
+}
+
+func (spool *Spool) remove(name string) {
+	file := filepath.Join(spool.dir, name)
+	info, err := os.Stat(file)
+	if err != nil {
+		// пачку уже удалили из-за превышения размера
+		return
+	}
+	if err := os.Remove(file); err != nil {
+		log.Println("Не удалось удалить пачку из спула: " + err.Error())
+		return
+	}
+	spool.size -= info.Size()
+}
+
+// Quarantine переносит пачку в подкаталог quarantine: повторная отправка не поможет, а файл остаётся для разбора.
+// Пачки в карантине входят в объём спула и удаляются первыми при превышении SPOOL_MAX_SIZE
+func (spool *Spool) Quarantine(name string) error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	dir := filepath.Join(spool.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(spool.dir, name), filepath.Join(dir, name))
+}
+
+// Size - объём пачек в спуле в байтах
+func (spool *Spool) Size() int64 {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return spool.size
+}
+
+// sender отправляет пачки из спула по порядку. Пока ClickHouse недоступен или отвечает ошибкой (сеть, 5xx, 401, 403,
+// 404 и т.д.), следующая пачка не отправляется, а попытки повторяются с экспоненциально растущей паузой до
+// RETRY_MAX_INTERVAL. Пачка, данные которой ClickHouse не смог разобрать (см. Permanent), переносится в карантин,
+// чтобы не блокировать остальные.
+// После stop отправляет то, что успеет без ошибок, остальное остаётся в спуле до следующего запуска
+func (dbconn *DBConn) sender(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	backoff := time.Second
+	for {
+		again := false
+		for _, name := range dbconn.spool.Batches() {
+			body, token, err := dbconn.spool.Read(name)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Println("Не удалось прочитать пачку " + name + " из спула: " + err.Error())
+				}
+				continue
+			}
+			err = dbconn.SendDataToClickHouseDB(body, token)
+			var chErr *ClickHouseError
+			if errors.As(err, &chErr) && chErr.Permanent() {
+				log.Printf("ClickHouse отверг пачку %s, переносим её в %s: %v\n", name, filepath.Join(dbconn.SPOOL_DIR, quarantineDir), err)
+				if err := dbconn.spool.Quarantine(name); err != nil {
+					log.Println("Не удалось перенести пачку в карантин, удаляем её, события потеряны: " + err.Error())
+					dbconn.spool.Remove(name)
+				}
+				again = true
+				continue
+			}
+			if err != nil {
+				log.Printf("Не удалось отправить пачку %s в БД, повторим через %s: %v\n", name, backoff, err)
+				select {
+				case <-stop:
+					log.Printf("В спуле осталось %d пачек, они будут отправлены после перезапуска\n", len(dbconn.spool.Batches()))
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > dbconn.RETRY_MAX_INTERVAL {
+					backoff = dbconn.RETRY_MAX_INTERVAL
+				}
+				again = true
+				break
+			}
+			dbconn.spool.Remove(name)
+			backoff = time.Second
+			again = true
+		}
+		if again {
+			continue
+		}
+		// спул пуст
+		select {
+		case <-stop:
+			if len(dbconn.spool.Batches()) == 0 {
+				return
+			}
+		case <-dbconn.spool.notify:
+		}
+	}
+}
+
+// upgradeSpool переводит пачки, сохранённые до перехода на MergeTree, в текущий формат строк: в них time -
+// число наносекунд для колонки Int64, а таблица теперь ждёт DateTime64 строкой
+func (dbconn *DBConn) upgradeSpool() {
+	upgraded := 0
+	for _, name := range dbconn.spool.Batches() {
+		body, _, err := dbconn.spool.Read(name)
+		if err != nil {
+			continue
+		}
+		converted, changed, err := convertLegacyTime(body)
+		if err != nil {
+			log.Println("Не удалось перевести пачку " + name + " в новый формат: " + err.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := dbconn.spool.Rewrite(name, converted); err != nil {
+			log.Println("Не удалось перезаписать пачку " + name + ": " + err.Error())
+			continue
+		}
+		upgraded++
+	}
+	if upgraded > 0 {
+		log.Printf("Пачек в спуле переведено в новый формат времени: %d\n", upgraded)
+	}
+}
+
+// convertLegacyTime заменяет в строках JSONEachRow числовое time (наносекунды Unix) на строку DateTime64.
+// false - в пачке нет строк старого формата
+func convertLegacyTime(body []byte) ([]byte, bool, error) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	changed := false
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		var row struct {
+			EventRow
+			Time json.RawMessage `json:"time"`
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(line, &row); err != nil {
+			return nil, false, err
+		}
+		if len(row.Time) == 0 || row.Time[0] == '"' {
+			out.Write(line)
+			continue
+		}
+		nanos, err := strconv.ParseInt(string(row.Time), 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		row.EventRow.Time = time.Unix(0, nanos).UTC().Format(eventTimeFormat)
+		if err := encoder.Encode(row.EventRow); err != nil {
+			return nil, false, err
+		}
+		changed = true
+	}
+	return out.Bytes(), changed, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpoolWriteReadRemove(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"aaa", "bbb", "ccc"} {
+		if err := spool.Write(token, []byte(token+"\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batches := spool.Batches()
+	if len(batches) != 3 || spool.Size() != 12 {
+		t.Fatalf("пачки %v, размер %d", batches, spool.Size())
+	}
+	// пачки отдаются в порядке записи
+	for i, want := range []string{"aaa", "bbb", "ccc"} {
+		body, token, err := spool.Read(batches[i])
+		if err != nil || token != want || string(body) != want+"\n" {
+			t.Errorf("пачка %d: %q %q %v", i, body, token, err)
+		}
+	}
+	spool.Remove(batches[0])
+	spool.Remove(batches[0])
+	if len(spool.Batches()) != 2 || spool.Size() != 8 {
+		t.Errorf("после удаления: %v, размер %d", spool.Batches(), spool.Size())
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"aaa", "bbb", "ccc"} {
+		if err := spool.Write(token, []byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batches := spool.Batches()
+	if len(batches) != 2 || spool.Size() != 8 {
+		t.Fatalf("пачки %v, размер %d", batches, spool.Size())
+	}
+	if _, token, _ := spool.Read(batches[0]); token != "bbb" {
+		t.Errorf("должна удаляться самая старая пачка, осталась %s", token)
+	}
+}
+
+func TestOpenSpoolRecovery(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Write("aaa", []byte("done\n")); err != nil {
+		t.Fatal(err)
+	}
+	// недописанная пачка после падения процесса
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000009-bbb.jsonl.tmp"), []byte("cut"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches := reopened.Batches(); len(batches) != 1 || reopened.Size() != 5 {
+		t.Errorf("после перезапуска: %v, размер %d", batches, reopened.Size())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000009-bbb.jsonl.tmp")); !os.IsNotExist(err) {
+		t.Errorf("временный файл не удалён: %v", err)
+	}
+	select {
+	case <-reopened.notify:
+	default:
+		t.Error("оставшиеся пачки должны отправляться сразу после запуска")
+	}
+}
+
+func TestSenderQuarantinesRejectedBatches(t *testing.T) {
+	var mu sync.Mutex
+	// ответ ClickHouse по токену пачки: первый раз из списка, дальше 200
+	responses := map[string][]int{"bad": {http.StatusBadRequest}, "busy": {http.StatusServiceUnavailable}, "denied": {http.StatusForbidden}}
+	var inserted []string
+	dbconn := testClickHouse(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		token := r.URL.Query().Get("insert_deduplication_token")
+		if codes := responses[token]; len(codes) > 0 {
+			responses[token] = codes[1:]
+			http.Error(w, "Code: 27. DB::Exception: Cannot parse input", codes[0])
+			return
+		}
+		inserted = append(inserted, token)
+	})
+	dbconn.SPOOL_DIR = t.TempDir()
+	dbconn.RETRY_MAX_INTERVAL = time.Second
+	spool, err := OpenSpool(dbconn.SPOOL_DIR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbconn.spool = spool
+	for _, token := range []string{"bad", "busy", "denied", "good"} {
+		if err := spool.Write(token, []byte("{}\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go dbconn.sender(stop, done)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spool.Batches()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 503 и 403 повторяются, и порядок пачек сохраняется, а неразобранные данные не блокируют остальные
+	if strings.Join(inserted, ",") != "busy,denied,good" || len(spool.Batches()) != 0 || spool.Size() != 3 {
+		t.Errorf("вставлены %v, в спуле %v", inserted, spool.Batches())
+	}
+	quarantined, _ := os.ReadDir(filepath.Join(dbconn.SPOOL_DIR, quarantineDir))
+	if len(quarantined) != 1 || !strings.HasSuffix(quarantined[0].Name(), "-bad.jsonl") {
+		t.Errorf("в карантине: %v", quarantined)
+	}
+}
+
+func TestClickHouseErrorPermanent(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		message   string
+		permanent bool
+	}{
+		{400, "Code: 27. DB::Exception: Cannot parse input: expected '\"' before: 'x'", true},
+		{400, "Code: 53. DB::Exception: Type mismatch", true},
+		{400, "Code: 62. DB::Exception: Syntax error", false},
+		{400, "Bad Request", false},
+		{401, "Code: 516. DB::Exception: default: Authentication failed", false},
+		{403, "Code: 497. DB::Exception: Not enough privileges", false},
+		{404, "Code: 60. DB::Exception: Table k8s.events does not exist", false},
+		{429, "", false},
+		{500, "Code: 27. DB::Exception: Cannot parse input", false},
+		{503, "", false},
+	} {
+		err := &ClickHouseError{StatusCode: tc.status, Code: clickHouseErrorCode("", tc.message), Message: tc.message}
+		if got := err.Permanent(); got != tc.permanent {
+			t.Errorf("%d %q: Permanent() = %v", tc.status, tc.message, got)
+		}
+	}
+	if code := clickHouseErrorCode("6", "Code: 27. DB::Exception"); code != 6 {
+		t.Errorf("код из X-ClickHouse-Exception-Code должен быть важнее текста: %d", code)
+	}
+}
+
+func TestSpoolQuarantineCountsTowardMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"bad", "good"} {
+		if err := spool.Write(token, []byte("1234")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := spool.Quarantine(spool.Batches()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if spool.Size() != 8 {
+		t.Errorf("пачки в карантине должны входить в объём спула: %d", spool.Size())
+	}
+	reopened, err := OpenSpool(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Size() != 8 {
+		t.Errorf("после перезапуска объём спула %d, ожидали 8", reopened.Size())
+	}
+	// при превышении первой удаляется пачка из карантина, а не неотправленная
+	if err := reopened.Write("new", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	quarantined, _ := os.ReadDir(filepath.Join(dir, quarantineDir))
+	if len(quarantined) != 0 || len(reopened.Batches()) != 2 || reopened.Size() != 8 {
+		t.Errorf("в карантине %v, в спуле %v, размер %d", quarantined, reopened.Batches(), reopened.Size())
+	}
+}
+
+func TestUpgradeSpoolLegacyTime(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"kind":"pod","name":"a","namespace":"app","reason":"created","text":"<\"x\">","time":1704164645123456789}` + "\n" +
+		`{"kind":"pod","name":"b","namespace":"app","reason":"created","text":"","time":"2024-01-02 03:04:05.000000000"}` + "\n"
+	current := `{"kind":"pod","name":"c","namespace":"app","reason":"created","text":"","time":"2024-01-02 03:04:05.000000000"}` + "\n"
+	for token, body := range map[string]string{"legacy": legacy, "current": current} {
+		if err := spool.Write(token, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dbconn := &DBConn{spool: spool}
+	dbconn.upgradeSpool()
+	bodies := map[string]string{}
+	var size int64
+	for _, name := range spool.Batches() {
+		body, token, _ := spool.Read(name)
+		bodies[token] = string(body)
+		size += int64(len(body))
+	}
+	want := `{"kind":"pod","name":"a","namespace":"app","reason":"created","text":"<\"x\">","time":"2024-01-02 03:04:05.123456789"}` + "\n" +
+		`{"kind":"pod","name":"b","namespace":"app","reason":"created","text":"","time":"2024-01-02 03:04:05.000000000"}` + "\n"
+	if bodies["legacy"] != want {
+		t.Errorf("старая пачка:\n%s\nожидали:\n%s", bodies["legacy"], want)
+	}
+	if bodies["current"] != current {
+		t.Errorf("пачка в новом формате изменилась:\n%s", bodies["current"])
+	}
+	if spool.Size() != size {
+		t.Errorf("размер спула %d, файлов %d байт", spool.Size(), size)
+	}
+}